@@ -3,23 +3,27 @@ set -eu
 
 export BUILDKITE_PLUGIN_S3_SECRETS_BUCKET=${TEST_BUCKET?}
 
+# hooks/environment assumes the `s3secrets-helper` binary is in $PATH, and so
+# does git-credential-s3-secrets, which git runs as a subprocess, so a shell
+# function won't do. Rather than install a Go toolchain onto the build agent,
+# build a static binary inside docker and put it in $PATH.
+bindir="$(mktemp -d)"
+docker run \
+  --rm \
+  --volume "$(pwd)/s3secrets-helper:/s3secrets-helper" \
+  --volume "$bindir:/out" \
+  --workdir /s3secrets-helper \
+  --env CGO_ENABLED=0 \
+  --user "$(id -u):$(id -g)" \
+  --env GOCACHE=/tmp/go-cache \
+  --env GOPATH=/tmp/go \
+  golang:1.26 \
+  go build -o /out/s3secrets-helper .
+export PATH="$bindir:$PATH"
+
 pre_exit() {
   source hooks/pre-exit
-}
-
-# hooks/environment assumes `s3secrets-helper` command is available, normally
-# by way of that binary existing in $PATH. But a shell function works too.
-# Rather than build/install s3secrets-helper onto the build agent, build and
-# run it inside docker.
-# Feel free to replace this terrible hack with something better.
-s3secrets-helper() {
-  docker run \
-    --rm \
-    --volume $(pwd)/s3secrets-helper:/s3secrets-helper \
-    --workdir /s3secrets-helper \
-    --env-file <(env | egrep 'AWS|BUILDKITE') \
-    golang:1.26 \
-    bash -c 'go build && ./s3secrets-helper'
+  rm -rf "$bindir"
 }
 
 trap pre_exit EXIT
@@ -29,9 +33,8 @@ if [[ -d example-private-repository ]] ; then
   rm -rf example-private-repository
 fi
 
-# Cannot use git+ssh because the ephemeral ssh-agent will be started in the
-# Docker container / pid namespace above and be terminated after the process
-# s3secrets-helper process exits
+# Clone with https to exercise the git credential helper, which runs
+# s3secrets-helper from $PATH
 echo "+++ Cloning private repository with https"
 git clone -- https://github.com/buildkite/example-private-repository.git example-private-repository
 rm -rf example-private-repository
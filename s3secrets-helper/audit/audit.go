@@ -0,0 +1,199 @@
+// Package audit records each access to a secret, so that who read what, and
+// when, can be answered without searching CloudTrail.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of fetching an object
+const (
+	OutcomeFetched   = "fetched"
+	OutcomeNotFound  = "not_found"
+	OutcomeForbidden = "forbidden"
+	OutcomeError     = "error"
+)
+
+// DefaultS3Prefix is the prefix within the secrets bucket that S3 sinks
+// write to by default
+const DefaultS3Prefix = "audit/"
+
+// Job identifies the job that accessed secrets
+type Job struct {
+	JobID     string `json:"job_id,omitempty"`
+	BuildID   string `json:"build_id,omitempty"`
+	Pipeline  string `json:"pipeline,omitempty"`
+	AgentName string `json:"agent_name,omitempty"`
+
+	// Source is the command that fetched, such as git-credential, or empty
+	// for the environment hook
+	Source string `json:"source,omitempty"`
+}
+
+// Record is a single access to an object. It never holds the object's
+// contents.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	VersionID string    `json:"version_id,omitempty"`
+	ETag      string    `json:"etag,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Job
+}
+
+// Sink receives audit records. Implementations must be safe for concurrent
+// use, as objects are fetched concurrently.
+type Sink interface {
+	Write(r Record) error
+
+	// Close flushes any buffered records
+	Close() error
+}
+
+// Putter uploads an object, such as *s3.Client
+type Putter interface {
+	Bucket() string
+	Put(key string, data []byte) error
+}
+
+// Open returns the sink described by spec:
+//
+//   - stderr writes JSON lines to stderr
+//   - s3 or s3:<prefix> uploads JSON lines to the secrets bucket, under
+//     DefaultS3Prefix unless a prefix is given
+//   - anything else is the path of a file that JSON lines are appended to
+//
+// An empty spec returns a nil Sink.
+func Open(spec string, putter Putter, job Job) (Sink, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "stderr":
+		return NewWriterSink(os.Stderr), nil
+	case spec == "s3":
+		return NewS3Sink(putter, DefaultS3Prefix, job), nil
+	case strings.HasPrefix(spec, "s3:"):
+		prefix := strings.TrimPrefix(spec, "s3:")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return NewS3Sink(putter, prefix, job), nil
+	default:
+		sink, err := OpenFileSink(spec)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+}
+
+// WriterSink writes records as JSON lines
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewWriterSink returns a sink writing JSON lines to w, which isn't closed
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// OpenFileSink returns a sink appending JSON lines to the file at path,
+// creating it readable only by the current user if it doesn't exist.
+func OpenFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &WriterSink{w: f, c: f}, nil
+}
+
+func (s *WriterSink) Write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// S3Sink buffers records and uploads them as a single JSON lines object when
+// closed, at <prefix><yyyy>/<mm>/<dd>/<pipeline>/<job id>.jsonl. Sinks for
+// other sources, which can run many times in a job, upload to
+// <job id>-<source>-<nanoseconds>.jsonl instead so they don't overwrite it.
+type S3Sink struct {
+	mu      sync.Mutex
+	putter  Putter
+	prefix  string
+	job     Job
+	now     func() time.Time
+	records []Record
+}
+
+// NewS3Sink returns a sink uploading to putter under prefix
+func NewS3Sink(putter Putter, prefix string, job Job) *S3Sink {
+	return &S3Sink{putter: putter, prefix: prefix, job: job, now: time.Now}
+}
+
+func (s *S3Sink) Write(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *S3Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) == 0 {
+		return nil
+	}
+	var data []byte
+	for _, r := range s.records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := s.putter.Put(s.Key(), data); err != nil {
+		return err
+	}
+	s.records = nil
+	return nil
+}
+
+// Key returns the key records are uploaded to
+func (s *S3Sink) Key() string {
+	now := s.now().UTC()
+	pipeline := s.job.Pipeline
+	if pipeline == "" {
+		pipeline = "unknown"
+	}
+	name := s.job.JobID
+	if name == "" {
+		name = fmt.Sprintf("local-%d", now.UnixNano())
+	}
+	if s.job.Source != "" {
+		name = fmt.Sprintf("%s-%s-%d", name, s.job.Source, now.UnixNano())
+	}
+	return fmt.Sprintf("%s%s/%s/%s.jsonl", s.prefix, now.Format("2006/01/02"), pipeline, name)
+}
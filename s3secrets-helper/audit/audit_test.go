@@ -0,0 +1,161 @@
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/audit"
+)
+
+type fakePutter struct {
+	objects map[string][]byte
+}
+
+func (p *fakePutter) Bucket() string {
+	return "bkt"
+}
+
+func (p *fakePutter) Put(key string, data []byte) error {
+	p.objects[key] = data
+	return nil
+}
+
+var job = audit.Job{JobID: "job-1", BuildID: "build-1", Pipeline: "my-pipeline", AgentName: "agent-1"}
+
+func record(key, outcome string) audit.Record {
+	return audit.Record{
+		Time:    time.Date(2026, 10, 18, 1, 2, 3, 0, time.UTC),
+		Bucket:  "bkt",
+		Key:     key,
+		Outcome: outcome,
+		Job:     job,
+	}
+}
+
+func readRecords(t *testing.T, data []byte) []audit.Record {
+	t.Helper()
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var r audit.Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// Records are appended across jobs
+	for _, key := range []string{"pipeline/env", "private_ssh_key"} {
+		sink, err := audit.Open(path, nil, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(record(key, audit.OutcomeFetched)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readRecords(t, data)
+	if len(records) != 2 || records[0].Key != "pipeline/env" || records[1].Key != "private_ssh_key" {
+		t.Errorf("unexpected records: %+v", records)
+	}
+	if records[0].JobID != "job-1" || records[0].AgentName != "agent-1" {
+		t.Errorf("expected job details in records, got %+v", records[0])
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := audit.NewWriterSink(&buf)
+	if err := sink.Write(record("env", audit.OutcomeNotFound)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"time":"2026-10-18T01:02:03Z","bucket":"bkt","key":"env","outcome":"not_found","job_id":"job-1","build_id":"build-1","pipeline":"my-pipeline","agent_name":"agent-1"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected record:\n-%s\n+%s", expected, buf.String())
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	for spec, prefix := range map[string]string{
+		"s3":              "audit/",
+		"s3:secret-audit": "secret-audit/",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			putter := &fakePutter{objects: map[string][]byte{}}
+			sink, err := audit.Open(spec, putter, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"env", "git-credentials"} {
+				if err := sink.Write(record(key, audit.OutcomeFetched)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(putter.objects) != 0 {
+				t.Errorf("expected nothing to be uploaded before Close, got %d objects", len(putter.objects))
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			key := prefix + time.Now().UTC().Format("2006/01/02") + "/my-pipeline/job-1.jsonl"
+			data, ok := putter.objects[key]
+			if !ok {
+				t.Fatalf("expected %s to be uploaded, got %v", key, putter.objects)
+			}
+			if records := readRecords(t, data); len(records) != 2 {
+				t.Errorf("expected 2 records, got %+v", records)
+			}
+		})
+	}
+}
+
+func TestS3SinkSource(t *testing.T) {
+	putter := &fakePutter{objects: map[string][]byte{}}
+	sourceJob := job
+	sourceJob.Source = "git-credential"
+	sink, err := audit.Open("s3", putter, sourceJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(record("git-credentials", audit.OutcomeFetched)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "audit/" + time.Now().UTC().Format("2006/01/02") + "/my-pipeline/job-1-git-credential-"
+	for key := range putter.objects {
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".jsonl") {
+			t.Errorf("expected a key starting %s, got %s", prefix, key)
+		}
+	}
+	if len(putter.objects) != 1 {
+		t.Errorf("expected 1 object, got %v", putter.objects)
+	}
+}
+
+func TestOpenNone(t *testing.T) {
+	sink, err := audit.Open("", nil, job)
+	if err != nil || sink != nil {
+		t.Errorf("expected no sink, got %v, %v", sink, err)
+	}
+}
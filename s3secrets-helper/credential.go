@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/audit"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/env"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/gitcredential"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/githubapp"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/s3"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+)
+
+const (
+	// gitCredentialCommand is the subcommand implementing a git credential
+	// helper
+	gitCredentialCommand = "git-credential"
+
+	// gitHubAppTokenCache is the file in the job directory that GitHub App
+	// installation tokens are cached in
+	gitHubAppTokenCache = "github-app-token.json"
+
+	// gitHubAppTimeout bounds the requests made to mint a GitHub App token
+	gitHubAppTimeout = 30 * time.Second
+)
+
+// gitCredentialWithError implements a git credential helper backed by a
+// git-credentials file in S3. It is invoked by git via the
+// git-credential-s3-secrets script as:
+//
+//	s3secrets-helper git-credential <bucket> <region> <key> <action>
+//
+// The credential whose URL best matches the protocol, host and path git asks
+// about is written to stdout; nothing is written if none match.
+//
+// With --github-app=<owner>/<repo>, key is instead the github-app directory
+// holding a GitHub App's app-id and private-key.pem, and an installation
+// token for that repository is written.
+func gitCredentialWithError(log *log.Logger, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet(gitCredentialCommand, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	githubAppRepo := flags.String("github-app", "", "mint a GitHub App installation token for this owner/repo")
+	githubAPIURL := flags.String("github-api-url", githubapp.DefaultAPIURL, "the GitHub REST API URL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	if len(args) < 3 {
+		return fmt.Errorf("usage: s3secrets-helper %s [--github-app=<owner>/<repo>] <bucket> <region> <key> [get|store|erase]", gitCredentialCommand)
+	}
+	bucket, region, key := args[0], args[1], args[2]
+
+	// The credentials in S3 are read only, so store and erase are ignored
+	if len(args) > 3 && args[3] != "get" {
+		return nil
+	}
+
+	req, err := gitcredential.ReadRequest(stdin)
+	if err != nil {
+		return err
+	}
+
+	s3Client, err := s3.New(log, bucket, region)
+	if err != nil {
+		return err
+	}
+	decrypters, err := newDecrypters(s3Client.Region())
+	if err != nil {
+		return err
+	}
+	keys, err := trustedKeys()
+	if err != nil {
+		return err
+	}
+	// Fetches are audited like the environment hook's, to their own records
+	// so the hook's aren't overwritten
+	auditJob := auditJobFromEnv(gitCredentialCommand)
+	auditSink, err := audit.Open(os.Getenv(env.EnvAudit), s3Client, auditJob)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", env.EnvAudit, err)
+	}
+	if auditSink != nil {
+		defer func() {
+			if err := auditSink.Close(); err != nil {
+				log.Printf("Warning: failed to write audit log: %v", err)
+			}
+		}()
+	}
+	client := secrets.WithAudit(s3Client, auditSink, auditJob, log)
+	client = secrets.WithDecrypters(secrets.WithVerification(client, keys), decrypters)
+
+	if *githubAppRepo != "" {
+		return gitHubAppCredential(log, client, *githubAppRepo, *githubAPIURL, key, req, stdout)
+	}
+
+	data, err := client.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to download s3://%s/%s: %w", bucket, key, err)
+	}
+
+	creds, errs := gitcredential.Parse(data)
+	for _, err := range errs {
+		log.Printf("Warning: ignoring s3://%s/%s %v", bucket, key, err)
+	}
+
+	c, ok := gitcredential.Match(creds, req)
+	if !ok {
+		return nil
+	}
+	return c.Write(stdout)
+}
+
+// gitHubAppCredential writes an installation token for repository, minted
+// with the GitHub App stored under dir, and adds it to the job's redactor.
+func gitHubAppCredential(log *log.Logger, client secrets.Client, repository, apiURL, dir string, req gitcredential.Request, stdout io.Writer) error {
+	owner, repo, ok := strings.Cut(repository, "/")
+	if !ok || owner == "" || repo == "" {
+		return fmt.Errorf("invalid GitHub repository %q, expected <owner>/<repo>", repository)
+	}
+
+	// Only answer for the GitHub host the token is valid for
+	host, err := githubapp.HostForAPI(apiURL)
+	if err != nil {
+		return err
+	}
+	if req.Protocol != "https" || req.Host != host {
+		return nil
+	}
+
+	// Only answer for the repository, as other repositories on the host may
+	// have credentials from other helpers
+	if !strings.EqualFold(strings.TrimSuffix(strings.Trim(req.Path, "/"), ".git"), repository) {
+		return nil
+	}
+
+	var cachePath string
+	jobDir := os.Getenv(env.EnvJobDir)
+	if jobDir != "" {
+		cachePath = filepath.Join(jobDir, gitHubAppTokenCache)
+	}
+
+	// Tokens are cached by where the App is stored, so a cached token is
+	// used without downloading its key
+	appLocation := fmt.Sprintf("s3://%s/%s", client.Bucket(), dir)
+	var token *githubapp.Token
+	if cachePath != "" {
+		token, _ = githubapp.ReadCachedToken(cachePath, appLocation, repository)
+	}
+	if token == nil {
+		token, err = mintGitHubAppToken(client, apiURL, dir, owner, repo)
+		if err != nil {
+			return err
+		}
+		if cachePath != "" {
+			if err := githubapp.WriteCachedToken(cachePath, appLocation, repository, token); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The token is redacted whenever it's read, whether minted or cached, as
+	// the helper has no way of knowing whether it already was
+	redactor := secrets.NewAgentRedactor(log, os.Getenv(env.EnvCacheDir), jobDir)
+	if err := redactor.Redact([]string{token.Token}); err != nil && !errors.Is(err, secrets.ErrAgentNotFound) {
+		log.Printf("Warning: failed to add the GitHub App token to the redactor: %v", err)
+	}
+
+	c := gitcredential.Credential{
+		Protocol: req.Protocol,
+		Host:     req.Host,
+		Path:     req.Path,
+		Username: githubapp.TokenUsername,
+		Password: token.Token,
+	}
+	return c.Write(stdout)
+}
+
+// mintGitHubAppToken downloads the GitHub App stored under dir and mints an
+// installation token with it for owner/repo
+func mintGitHubAppToken(client secrets.Client, apiURL, dir, owner, repo string) (*githubapp.Token, error) {
+	id, err := client.Get(dir + "/app-id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download s3://%s/%s/app-id: %w", client.Bucket(), dir, err)
+	}
+	pem, err := client.Get(dir + "/private-key.pem")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download s3://%s/%s/private-key.pem: %w", client.Bucket(), dir, err)
+	}
+	privateKey, err := githubapp.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub App private key in s3://%s/%s: %w", client.Bucket(), dir, err)
+	}
+
+	app := &githubapp.App{
+		ID:     strings.TrimSpace(string(id)),
+		Key:    privateKey,
+		APIURL: apiURL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitHubAppTimeout)
+	defer cancel()
+
+	token, err := app.InstallationToken(ctx, owner, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mint a GitHub App token for %s/%s: %w", owner, repo, err)
+	}
+	return token, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/envelope"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/kms"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+)
+
+// encryptCommand is the subcommand that encrypts a secret for uploading
+const encryptCommand = "encrypt"
+
+// encryptUsage describes the arguments of the encrypt subcommand
+const encryptUsage = "usage: s3secrets-helper " + encryptCommand +
+	" --key <s3-key> [--region <region>] [--context k=v,...] <kms-key-id>" +
+	" | --key <s3-key> --age <recipient>[,...] [--armor]"
+
+// encryptWithError reads a secret from stdin and writes it to stdout
+// encrypted for the S3 key it will be uploaded to, which it can't be
+// decrypted from any other key as. By default it's encrypted in an envelope,
+// with a data key from a KMS key; with --age, it's encrypted with age:
+//
+//	s3secrets-helper encrypt --key my-pipeline/env [--region <region>] [--context k=v,...] <kms-key-id> < secret > env.enc
+//	s3secrets-helper encrypt --key my-pipeline/env --age <recipient>[,...] [--armor] < secret > env.age
+func encryptWithError(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet(encryptCommand, flag.ContinueOnError)
+	objectKey := flags.String("key", "", "the S3 key the secret is uploaded to, with or without the .enc or .age suffix")
+	region := flags.String("region", "", "the region of the KMS key, defaulting to the AWS SDK's")
+	encryptionContext := flags.String("context", "", "a KMS encryption context, as comma separated key=value pairs")
+	ageRecipients := flags.String("age", "", "encrypt with age to these comma separated recipients, rather than with KMS")
+	ageArmor := flags.Bool("armor", false, "write age output in the PEM-like armored format")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	key := strings.TrimSuffix(strings.TrimSuffix(*objectKey, envelope.Suffix), secrets.AgeSuffix)
+	if key == "" {
+		return fmt.Errorf("--key is required\n%s", encryptUsage)
+	}
+
+	plaintext, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+
+	if *ageRecipients != "" {
+		if flags.NArg() != 0 {
+			return fmt.Errorf("%s", encryptUsage)
+		}
+		return ageEncrypt(stdout, key, splitList(*ageRecipients), *ageArmor, plaintext)
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%s", encryptUsage)
+	}
+	keyID := flags.Arg(0)
+
+	var kmsContext map[string]string
+	for _, pair := range splitList(*encryptionContext) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid encryption context %q, expected key=value", pair)
+		}
+		if kmsContext == nil {
+			kmsContext = map[string]string{}
+		}
+		kmsContext[k] = v
+	}
+
+	client, err := kms.New(*region)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	data, err := envelope.Encrypt(ctx, client, keyID, key, kmsContext, plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(append(data, '\n'))
+	return err
+}
+
+// ageEncrypt writes plaintext, bound to key, encrypted with age to recipients
+func ageEncrypt(stdout io.Writer, key string, recipients []string, armored bool, plaintext []byte) error {
+	var parsed []age.Recipient
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return fmt.Errorf("invalid age recipient %q: %w", r, err)
+		}
+		parsed = append(parsed, recipient)
+	}
+
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var a io.WriteCloser
+	if armored {
+		a = armor.NewWriter(&buf)
+		out = a
+	}
+	w, err := age.Encrypt(out, parsed...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(secrets.AgePlaintext(key, plaintext)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if a != nil {
+		if err := a.Close(); err != nil {
+			return err
+		}
+	}
+	_, err = stdout.Write(buf.Bytes())
+	return err
+}
@@ -8,4 +8,26 @@ const (
 	EnvRepo                      = "BUILDKITE_REPO"
 	EnvCredHelper                = "BUILDKITE_PLUGIN_S3_SECRETS_CREDHELPER"
 	EnvSkipSSHKeyNotFoundWarning = "BUILDKITE_PLUGIN_S3_SECRETS_SKIP_SSH_KEY_NOT_FOUND_WARNING"
+	EnvJobDir                    = "BUILDKITE_PLUGIN_S3_SECRETS_JOB_DIR"
+	EnvGitHubAPIURL              = "BUILDKITE_PLUGIN_S3_SECRETS_GITHUB_API_URL"
+	EnvEnvRedaction              = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_REDACTION"
+	EnvEnvRedactionMinLength     = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_REDACTION_MIN_LENGTH"
+	EnvEnvRedactionAllowlist     = "BUILDKITE_PLUGIN_S3_SECRETS_ENV_REDACTION_ALLOWLIST"
+	EnvDebug                     = "BUILDKITE_PLUGIN_S3_SECRETS_DEBUG"
+	EnvRequireRedaction          = "BUILDKITE_PLUGIN_S3_SECRETS_REQUIRE_REDACTION"
+	EnvCacheDir                  = "BUILDKITE_PLUGIN_S3_SECRETS_CACHE_DIR"
+	EnvAnnotate                  = "BUILDKITE_PLUGIN_S3_SECRETS_ANNOTATE"
+	EnvJobID                     = "BUILDKITE_JOB_ID"
+	EnvBuildID                   = "BUILDKITE_BUILD_ID"
+	EnvAgentName                 = "BUILDKITE_AGENT_NAME"
+	EnvAudit                     = "BUILDKITE_PLUGIN_S3_SECRETS_AUDIT"
+	EnvEnvelopeEncryption        = "BUILDKITE_PLUGIN_S3_SECRETS_ENVELOPE_ENCRYPTION"
+	EnvAgeIdentityFile           = "BUILDKITE_PLUGIN_S3_SECRETS_AGE_IDENTITY_FILE"
+	EnvTrustedKeysFile           = "BUILDKITE_PLUGIN_S3_SECRETS_TRUSTED_KEYS_FILE"
+	EnvExpiryWarningDays         = "BUILDKITE_PLUGIN_S3_SECRETS_EXPIRY_WARNING_DAYS"
+	EnvRefuseExpired             = "BUILDKITE_PLUGIN_S3_SECRETS_REFUSE_EXPIRED"
+	EnvStepKey                   = "BUILDKITE_STEP_KEY"
+	EnvStepOnly                  = "BUILDKITE_PLUGIN_S3_SECRETS_STEP_ONLY"
+	EnvSOPSAgeKey                = "SOPS_AGE_KEY"
+	EnvSOPSAgeKeyFile            = "SOPS_AGE_KEY_FILE"
 )
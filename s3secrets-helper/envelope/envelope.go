@@ -0,0 +1,135 @@
+// Package envelope implements client-side envelope encryption of secrets:
+// each secret is encrypted with its own AES-256-GCM data key, which is in turn
+// encrypted with a KMS key and stored alongside the ciphertext. Reading a
+// secret needs kms:Decrypt on that key as well as access to the object, and
+// the object is opaque to anything that copies it, such as S3 replication.
+// The S3 key an envelope is stored under is authenticated as additional data,
+// so an envelope moved to another key fails to decrypt.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Suffix is appended to the keys of envelope encrypted objects
+	Suffix = ".enc"
+
+	// Version is the envelope format version
+	Version = 1
+
+	// Algorithm is the only supported data encryption algorithm
+	Algorithm = "AES-256-GCM"
+)
+
+// Envelope is the JSON stored in an encrypted object. Byte slices are
+// base64 encoded.
+type Envelope struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+
+	// KeyID is the KMS key the data key was encrypted with, for reference;
+	// KMS finds the key from EncryptedKey when decrypting
+	KeyID string `json:"kms_key_id,omitempty"`
+
+	// EncryptedKey is the data key, encrypted by KMS
+	EncryptedKey []byte `json:"encrypted_key"`
+
+	// Context is the KMS encryption context, which must match to decrypt
+	Context map[string]string `json:"encryption_context,omitempty"`
+
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// KMS decrypts data keys
+type KMS interface {
+	Decrypt(ctx context.Context, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+// KeyGenerator generates data keys, returning them in plaintext and encrypted
+// with keyID
+type KeyGenerator interface {
+	GenerateDataKey(ctx context.Context, keyID string, encryptionContext map[string]string) (plaintext, encrypted []byte, err error)
+}
+
+// ErrNotEnvelope is returned for data that isn't an envelope
+var ErrNotEnvelope = errors.New("not an encrypted envelope")
+
+// Decrypt decrypts the envelope in data, which must have been encrypted for
+// the S3 key objectKey
+func Decrypt(ctx context.Context, kms KMS, objectKey string, data []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotEnvelope, err)
+	}
+	if env.Version != Version {
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	if env.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported envelope algorithm %q", env.Algorithm)
+	}
+	if len(env.EncryptedKey) == 0 || len(env.Ciphertext) == 0 {
+		return nil, fmt.Errorf("%w: missing encrypted_key or ciphertext", ErrNotEnvelope)
+	}
+
+	key, err := kms.Decrypt(ctx, env.EncryptedKey, env.Context)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting data key: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(env.Nonce))
+	}
+	plaintext, err := gcm.Open(nil, env.Nonce, env.Ciphertext, []byte(objectKey))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting ciphertext: message authentication failed, or not encrypted for %s", objectKey)
+	}
+	return plaintext, nil
+}
+
+// Encrypt encrypts plaintext for the S3 key objectKey with a new data key
+// from the KMS key keyID, and returns the envelope as JSON
+func Encrypt(ctx context.Context, kms KeyGenerator, keyID, objectKey string, encryptionContext map[string]string, plaintext []byte) ([]byte, error) {
+	key, encryptedKey, err := kms.GenerateDataKey(ctx, keyID, encryptionContext)
+	if err != nil {
+		return nil, fmt.Errorf("generating data key: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{
+		Version:      Version,
+		Algorithm:    Algorithm,
+		KeyID:        keyID,
+		EncryptedKey: encryptedKey,
+		Context:      encryptionContext,
+		Nonce:        nonce,
+		Ciphertext:   gcm.Seal(nil, nonce, plaintext, []byte(objectKey)),
+	})
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid data key length %d, expected 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,122 @@
+package envelope_test
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"testing"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/envelope"
+)
+
+// fakeKMS keeps data keys in memory, handing out their index as the
+// encrypted key
+type fakeKMS struct {
+	keys []fakeDataKey
+}
+
+type fakeDataKey struct {
+	plaintext []byte
+	context   map[string]string
+}
+
+func (k *fakeKMS) GenerateDataKey(ctx context.Context, keyID string, encryptionContext map[string]string) ([]byte, []byte, error) {
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, err
+	}
+	k.keys = append(k.keys, fakeDataKey{plaintext, encryptionContext})
+	return plaintext, []byte(fmt.Sprint(len(k.keys) - 1)), nil
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	for i, key := range k.keys {
+		if string(encryptedKey) != fmt.Sprint(i) {
+			continue
+		}
+		if !maps.Equal(key.context, encryptionContext) {
+			return nil, errors.New("InvalidCiphertextException")
+		}
+		return key.plaintext, nil
+	}
+	return nil, errors.New("InvalidCiphertextException")
+}
+
+func TestRoundTrip(t *testing.T) {
+	kms := &fakeKMS{}
+	encCtx := map[string]string{"pipeline": "my-pipeline"}
+	data, err := envelope.Encrypt(context.Background(), kms, "alias/secrets", "pipeline/env", encCtx, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Errorf("expected envelope not to contain the plaintext: %s", data)
+	}
+
+	var env envelope.Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != envelope.Version || env.Algorithm != envelope.Algorithm || env.KeyID != "alias/secrets" || env.Context["pipeline"] != "my-pipeline" {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+
+	plaintext, err := envelope.Decrypt(context.Background(), kms, "pipeline/env", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "hunter2" {
+		t.Errorf("expected hunter2, got %q", plaintext)
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	kms := &fakeKMS{}
+	data, err := envelope.Encrypt(context.Background(), kms, "alias/secrets", "pipeline/env", map[string]string{"pipeline": "my-pipeline"}, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(f func(env *envelope.Envelope)) []byte {
+		var env envelope.Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatal(err)
+		}
+		f(&env)
+		modified, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return modified
+	}
+
+	for name, tc := range map[string]struct {
+		data        []byte
+		key         string
+		notEnvelope bool
+	}{
+		"wrong key":       {data: data, key: "other-pipeline/env"},
+		"plaintext":       {data: []byte("A=one"), notEnvelope: true},
+		"other json":      {data: []byte(`{"A":"one"}`)},
+		"tampered":        {data: modify(func(env *envelope.Envelope) { env.Ciphertext[0] ^= 1 })},
+		"wrong context":   {data: modify(func(env *envelope.Envelope) { env.Context["pipeline"] = "other" })},
+		"wrong version":   {data: modify(func(env *envelope.Envelope) { env.Version = 2 })},
+		"wrong algorithm": {data: modify(func(env *envelope.Envelope) { env.Algorithm = "AES-128-CBC" })},
+		"short nonce":     {data: modify(func(env *envelope.Envelope) { env.Nonce = env.Nonce[:4] })},
+	} {
+		t.Run(name, func(t *testing.T) {
+			key := cmp.Or(tc.key, "pipeline/env")
+			plaintext, err := envelope.Decrypt(context.Background(), kms, key, tc.data)
+			if err == nil {
+				t.Fatalf("expected an error, got %q", plaintext)
+			}
+			if errors.Is(err, envelope.ErrNotEnvelope) != tc.notEnvelope {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Package githubapp mints short-lived GitHub App installation access tokens,
+// which are used as git credentials in place of long-lived personal access
+// tokens. See https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app
+package githubapp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAPIURL is the GitHub.com REST API. GitHub Enterprise Server uses
+	// https://<hostname>/api/v3
+	DefaultAPIURL = "https://api.github.com"
+
+	// TokenUsername is the username git uses with an installation token
+	TokenUsername = "x-access-token"
+
+	// cacheMargin is how long before its expiry a cached token is replaced,
+	// so a token isn't handed to git just as it expires
+	cacheMargin = 5 * time.Minute
+)
+
+// App authenticates as a GitHub App to mint installation tokens.
+type App struct {
+	// ID is the App ID, or its client ID
+	ID string
+
+	// Key is the App's private key
+	Key *rsa.PrivateKey
+
+	// APIURL is the base URL of the REST API, defaulting to DefaultAPIURL
+	APIURL string
+
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Token is an installation access token.
+type Token struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ParsePrivateKey parses a PEM encoded RSA private key, as downloaded from a
+// GitHub App's settings (PKCS#1) or converted to PKCS#8.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("not an RSA private key in PKCS#1 or PKCS#8 format")
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+// HostForAPI returns the git host served by a REST API base URL, e.g.
+// github.com for https://api.github.com.
+func HostForAPI(apiURL string) (string, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid GitHub API URL %q", apiURL)
+	}
+	if u.Host == "api.github.com" {
+		return "github.com", nil
+	}
+	return u.Host, nil
+}
+
+// ParseRepo returns the owner and name of a repository from its clone URL,
+// in any of the forms git@host:owner/repo.git, ssh://git@host/owner/repo.git
+// or https://host/owner/repo.git.
+func ParseRepo(repoURL string) (owner, repo string, err error) {
+	path := ""
+	if u, err := url.Parse(repoURL); err == nil && u.Scheme != "" && u.Host != "" {
+		path = u.Path
+	} else if _, p, ok := strings.Cut(repoURL, ":"); ok {
+		path = p
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	owner, repo, ok := strings.Cut(path, "/")
+	if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+		return "", "", fmt.Errorf("can't find a GitHub owner and repository in %q", repoURL)
+	}
+	return owner, repo, nil
+}
+
+// InstallationToken mints a token for the installation of the App on a
+// repository, with access limited to that repository.
+func (a *App) InstallationToken(ctx context.Context, owner, repo string) (*Token, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	path := fmt.Sprintf("/repos/%s/%s/installation", url.PathEscape(owner), url.PathEscape(repo))
+	if err := a.do(ctx, http.MethodGet, path, nil, &installation); err != nil {
+		return nil, fmt.Errorf("finding the installation of GitHub App %s for %s/%s: %w", a.ID, owner, repo, err)
+	}
+
+	body, err := json.Marshal(map[string][]string{"repositories": {repo}})
+	if err != nil {
+		return nil, err
+	}
+	var token Token
+	path = fmt.Sprintf("/app/installations/%d/access_tokens", installation.ID)
+	if err := a.do(ctx, http.MethodPost, path, body, &token); err != nil {
+		return nil, fmt.Errorf("creating an installation token for GitHub App %s: %w", a.ID, err)
+	}
+	if token.Token == "" {
+		return nil, fmt.Errorf("creating an installation token for GitHub App %s: empty token in response", a.ID)
+	}
+	return &token, nil
+}
+
+// do makes a request to the API authenticated as the App, decoding a JSON
+// response into out.
+func (a *App) do(ctx context.Context, method, path string, body []byte, out any) error {
+	jwt, err := a.jwt()
+	if err != nil {
+		return err
+	}
+	base := a.APIURL
+	if base == "" {
+		base = DefaultAPIURL
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(base, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("User-Agent", "elastic-ci-stack-s3-secrets-hooks")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := a.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &apiErr)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, apiErr.Message)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// jwt returns a JSON Web Token signed with the App's private key, valid for
+// ten minutes as allowed by GitHub, with a minute of allowance for clock
+// drift.
+func (a *App) jwt() (string, error) {
+	t := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iat": t.Add(-time.Minute).Unix(),
+		"exp": t.Add(9 * time.Minute).Unix(),
+		"iss": a.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing GitHub App JWT: %w", err)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// cachedToken is the JSON document stored in a token cache file.
+type cachedToken struct {
+	App        string `json:"app"`
+	Repository string `json:"repository"`
+	Token
+}
+
+// ReadCachedToken returns the token in the cache file at cachePath if it was
+// minted by app for repository and isn't about to expire. app is any string
+// identifying the App, such as where its private key is stored, so the App
+// doesn't need to be loaded to use its cached token.
+func ReadCachedToken(cachePath, app, repository string) (*Token, bool) {
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedToken
+	if json.Unmarshal(data, &cached) != nil ||
+		cached.App != app || cached.Repository != repository ||
+		time.Until(cached.ExpiresAt) <= cacheMargin {
+		return nil, false
+	}
+	return &cached.Token, true
+}
+
+// WriteCachedToken stores token, minted by app for repository, in the cache
+// file at cachePath, readable only by the current user.
+func WriteCachedToken(cachePath, app, repository string, token *Token) error {
+	data, err := json.Marshal(cachedToken{App: app, Repository: repository, Token: *token})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cachePath, data, 0o600); err != nil {
+		return fmt.Errorf("caching GitHub App token: %w", err)
+	}
+	return nil
+}
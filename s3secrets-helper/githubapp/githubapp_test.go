@@ -0,0 +1,179 @@
+package githubapp_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/githubapp"
+)
+
+// fakeGitHub is a stand-in for the parts of the GitHub REST API used to mint
+// installation tokens.
+func fakeGitHub(t *testing.T, key *rsa.PrivateKey, minted *int) *httptest.Server {
+	verify := func(r *http.Request) bool {
+		jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return false
+		}
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			return false
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+			return false
+		}
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		var c struct {
+			Iss string `json:"iss"`
+		}
+		return json.Unmarshal(claims, &c) == nil && c.Iss == "12345"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v3/repos/my-org/my-repo/installation", func(w http.ResponseWriter, r *http.Request) {
+		if !verify(r) {
+			http.Error(w, `{"message": "bad JWT"}`, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"id": 42}`)
+	})
+	mux.HandleFunc("POST /api/v3/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if !verify(r) {
+			http.Error(w, `{"message": "bad JWT"}`, http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"repositories":["my-repo"]}` {
+			t.Errorf("unexpected access token request %s", body)
+		}
+		*minted++
+		fmt.Fprintf(w, `{"token": "ghs_token%d", "expires_at": %q}`, *minted, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestInstallationToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minted := 0
+	server := fakeGitHub(t, key, &minted)
+
+	parsed, err := githubapp.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &githubapp.App{ID: "12345", Key: parsed, APIURL: server.URL + "/api/v3"}
+
+	token, err := app.InstallationToken(context.Background(), "my-org", "my-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "ghs_token1", token.Token; expected != actual {
+		t.Errorf("expected token %q, got %q", expected, actual)
+	}
+	if minted != 1 {
+		t.Errorf("expected a single token to be minted, got %d", minted)
+	}
+
+	if _, err := app.InstallationToken(context.Background(), "my-org", "other-repo"); err == nil {
+		t.Error("expected an error for a repository without an installation")
+	}
+
+	wrongKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badApp := &githubapp.App{ID: "12345", Key: wrongKey, APIURL: server.URL + "/api/v3"}
+	if _, err := badApp.InstallationToken(context.Background(), "my-org", "my-repo"); err == nil || !strings.Contains(err.Error(), "bad JWT") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestCachedToken(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "token.json")
+	if _, ok := githubapp.ReadCachedToken(cachePath, "s3://bkt/github-app", "my-org/my-repo"); ok {
+		t.Error("expected no token before one is cached")
+	}
+
+	token := &githubapp.Token{Token: "ghs_token1", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := githubapp.WriteCachedToken(cachePath, "s3://bkt/github-app", "my-org/my-repo", token); err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := githubapp.ReadCachedToken(cachePath, "s3://bkt/github-app", "my-org/my-repo")
+	if !ok || cached.Token != "ghs_token1" {
+		t.Errorf("expected the cached token, got %+v, %v", cached, ok)
+	}
+
+	for _, tc := range []struct{ app, repository string }{
+		{"s3://bkt/pipeline/github-app", "my-org/my-repo"},
+		{"s3://bkt/github-app", "my-org/other-repo"},
+	} {
+		if _, ok := githubapp.ReadCachedToken(cachePath, tc.app, tc.repository); ok {
+			t.Errorf("expected no cached token for %s %s", tc.app, tc.repository)
+		}
+	}
+
+	expiring := &githubapp.Token{Token: "ghs_token2", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := githubapp.WriteCachedToken(cachePath, "s3://bkt/github-app", "my-org/my-repo", expiring); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := githubapp.ReadCachedToken(cachePath, "s3://bkt/github-app", "my-org/my-repo"); ok {
+		t.Error("expected a token about to expire not to be used")
+	}
+}
+
+func TestParseRepo(t *testing.T) {
+	for _, repoURL := range []string{
+		"git@github.com:my-org/my-repo.git",
+		"ssh://git@github.com/my-org/my-repo.git",
+		"https://github.com/my-org/my-repo.git",
+		"https://github.com/my-org/my-repo",
+	} {
+		owner, repo, err := githubapp.ParseRepo(repoURL)
+		if err != nil || owner != "my-org" || repo != "my-repo" {
+			t.Errorf("%s: expected my-org/my-repo, got %s/%s (%v)", repoURL, owner, repo, err)
+		}
+	}
+	if _, _, err := githubapp.ParseRepo("https://github.com/my-org"); err == nil {
+		t.Error("expected an error for a URL without a repository")
+	}
+}
+
+func TestHostForAPI(t *testing.T) {
+	for apiURL, expected := range map[string]string{
+		githubapp.DefaultAPIURL:          "github.com",
+		"https://ghe.example.com/api/v3": "ghe.example.com",
+		"http://127.0.0.1:8080/api/v3":   "127.0.0.1:8080",
+	} {
+		if host, err := githubapp.HostForAPI(apiURL); err != nil || host != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", apiURL, expected, host, err)
+		}
+	}
+}
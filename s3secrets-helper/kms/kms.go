@@ -0,0 +1,107 @@
+// Package kms adapts AWS KMS to the interfaces used for envelope encryption.
+package kms
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+type Client struct {
+	kms *kms.Client
+}
+
+// New returns a client for KMS in region, or the default region if empty
+func New(region string) (*Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load the AWS SDK config (%v)", err)
+	}
+	return &Client{kms: kms.NewFromConfig(awsConfig)}, nil
+}
+
+// Decrypt decrypts a data key
+func (c *Client) Decrypt(ctx context.Context, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	out, err := c.kms.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    encryptedKey,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not Decrypt. Ensure your IAM Identity has kms:Decrypt permission for the key. (%v)", err)
+	}
+	return out.Plaintext, nil
+}
+
+// GenerateDataKey generates an AES-256 data key encrypted with keyID
+func (c *Client) GenerateDataKey(ctx context.Context, keyID string, encryptionContext map[string]string) ([]byte, []byte, error) {
+	out, err := c.kms.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(keyID),
+		KeySpec:           types.DataKeySpecAes256,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not GenerateDataKey (%s). Ensure your IAM Identity has kms:GenerateDataKey permission for the key. (%v)", keyID, err)
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// Regions creates clients for the regions of the keys it's asked to use,
+// for documents such as those encrypted with SOPS that name their keys
+type Regions struct {
+	defaultRegion string
+
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// NewRegions returns a Regions that uses defaultRegion for keys given by ID
+// or alias rather than ARN
+func NewRegions(defaultRegion string) *Regions {
+	return &Regions{defaultRegion: defaultRegion, clients: map[string]*Client{}}
+}
+
+// DecryptKey decrypts a data key encrypted with the key arn, in the region
+// of the ARN
+func (r *Regions) DecryptKey(ctx context.Context, arn string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	region := r.defaultRegion
+	if parts := strings.Split(arn, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	client, err := r.client(region)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.kms.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:             aws.String(arn),
+		CiphertextBlob:    encryptedKey,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not Decrypt. Ensure your IAM Identity has kms:Decrypt permission for the key. (%v)", err)
+	}
+	return out.Plaintext, nil
+}
+
+func (r *Regions) client(region string) (*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.clients[region]; ok {
+		return c, nil
+	}
+	c, err := New(region)
+	if err != nil {
+		return nil, err
+	}
+	r.clients[region] = c
+	return c, nil
+}
@@ -4,16 +4,36 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"filippo.io/age"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/audit"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/env"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/kms"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/s3"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/secrets"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/signature"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sops"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sshagent"
 )
 
 func main() {
 	log := log.New(os.Stderr, "", log.Lmsgprefix)
+	if len(os.Args) > 1 && os.Args[1] == encryptCommand {
+		if err := encryptWithError(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("encrypt: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == gitCredentialCommand {
+		if err := gitCredentialWithError(log, os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("git-credential-s3-secrets: %v", err)
+		}
+		return
+	}
 	if err := mainWithError(log); err != nil {
 		log.Fatalf("fatal error: %v", err)
 	}
@@ -48,7 +68,50 @@ func mainWithError(log *log.Logger) error {
 		return fmt.Errorf("The %s environment variable is required, set it to the path of the git-credential-s3-secrets script.", env.EnvCredHelper)
 	}
 
-	return secrets.Run(&secrets.Config{
+	envRedaction, err := secrets.ParseEnvRedaction(os.Getenv(env.EnvEnvRedaction))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", env.EnvEnvRedaction, err)
+	}
+
+	var envRedactionMinLength int
+	if v := os.Getenv(env.EnvEnvRedactionMinLength); v != "" {
+		envRedactionMinLength, err = strconv.Atoi(v)
+		if err != nil || envRedactionMinLength < 1 {
+			return fmt.Errorf("invalid %s %q, expected a positive number", env.EnvEnvRedactionMinLength, v)
+		}
+	}
+
+	var expiryWarning time.Duration
+	if v := os.Getenv(env.EnvExpiryWarningDays); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return fmt.Errorf("invalid %s %q, expected a positive number", env.EnvExpiryWarningDays, v)
+		}
+		expiryWarning = time.Duration(days) * 24 * time.Hour
+	}
+
+	decrypters, err := newDecrypters(client.Region())
+	if err != nil {
+		return err
+	}
+
+	keys, err := trustedKeys()
+	if err != nil {
+		return err
+	}
+
+	ageIdentities, err := sopsAgeIdentities()
+	if err != nil {
+		return err
+	}
+
+	auditJob := auditJobFromEnv("")
+	auditSink, err := audit.Open(os.Getenv(env.EnvAudit), client, auditJob)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", env.EnvAudit, err)
+	}
+
+	runErr := secrets.Run(&secrets.Config{
 		Repo:                      os.Getenv(env.EnvRepo),
 		Bucket:                    bucket,
 		Prefix:                    prefix,
@@ -57,11 +120,151 @@ func mainWithError(log *log.Logger) error {
 		SSHAgent:                  agent,
 		EnvSink:                   os.Stdout,
 		GitCredentialHelper:       credHelper,
+		GitHubAPIURL:              os.Getenv(env.EnvGitHubAPIURL),
+		EnvRedaction:              envRedaction,
+		EnvRedactionMinLength:     envRedactionMinLength,
+		EnvRedactionAllowlist:     splitList(os.Getenv(env.EnvEnvRedactionAllowlist)),
+		Debug:                     isEnvVarEnabled(env.EnvDebug),
+		RequireRedaction:          isEnvVarEnabled(env.EnvRequireRedaction),
+		CacheDir:                  os.Getenv(env.EnvCacheDir),
+		Annotate:                  isEnvVarEnabled(env.EnvAnnotate),
+		JobID:                     os.Getenv(env.EnvJobID),
+		Decrypters:                decrypters,
+		TrustedKeys:               keys,
+		SOPSKeys:                  sops.Keys{KMS: kms.NewRegions(client.Region()), AgeIdentities: ageIdentities},
+		ExpiryWarning:             expiryWarning,
+		RefuseExpired:             isEnvVarEnabled(env.EnvRefuseExpired),
+		StepKey:                   os.Getenv(env.EnvStepKey),
+		StepOnly:                  isEnvVarEnabled(env.EnvStepOnly),
+		Audit:                     auditSink,
+		AuditJob:                  auditJob,
 		SkipSSHKeyNotFoundWarning: isEnvVarEnabled(env.EnvSkipSSHKeyNotFoundWarning),
 	})
+
+	if auditSink != nil {
+		if err := auditSink.Close(); err != nil {
+			log.Printf("+++ :warning: Failed to write audit log: %v", err)
+		}
+	}
+	return runErr
+}
+
+// auditJobFromEnv returns the job that audit records are attributed to, with
+// source naming the command fetching
+func auditJobFromEnv(source string) audit.Job {
+	return audit.Job{
+		JobID:     os.Getenv(env.EnvJobID),
+		BuildID:   os.Getenv(env.EnvBuildID),
+		Pipeline:  os.Getenv(env.EnvPipeline),
+		AgentName: os.Getenv(env.EnvAgentName),
+		Source:    source,
+	}
 }
 
 func isEnvVarEnabled(envVar string) bool {
 	value := os.Getenv(envVar)
 	return strings.ToLower(value) == "true" || value == "1"
 }
+
+// splitList splits a comma separated list, ignoring whitespace and empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newDecrypters returns the decrypters enabled by the environment, for
+// objects in a bucket in region
+func newDecrypters(region string) ([]secrets.Decrypter, error) {
+	var decrypters []secrets.Decrypter
+	if isEnvVarEnabled(env.EnvEnvelopeEncryption) {
+		client, err := kms.New(region)
+		if err != nil {
+			return nil, err
+		}
+		decrypters = append(decrypters, secrets.NewEnvelopeDecrypter(client))
+	}
+	if path := os.Getenv(env.EnvAgeIdentityFile); path != "" {
+		identities, err := readAgeIdentities(path)
+		if err != nil {
+			return nil, err
+		}
+		decrypters = append(decrypters, secrets.NewAgeDecrypter(identities))
+	}
+	return decrypters, nil
+}
+
+// trustedKeys returns the public keys that must have signed every object
+// loaded, if a file of them is configured
+func trustedKeys() ([]signature.PublicKey, error) {
+	path := os.Getenv(env.EnvTrustedKeysFile)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+	keys, err := signature.ParsePublicKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trusted keys in %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// sopsAgeIdentities returns the age identities for SOPS encrypted env files,
+// from the same places as sops: SOPS_AGE_KEY, SOPS_AGE_KEY_FILE, or
+// sops/age/keys.txt in the user's config directory. The identity file for
+// .age objects is also used, if set.
+func sopsAgeIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+	if path := os.Getenv(env.EnvAgeIdentityFile); path != "" {
+		var err error
+		if identities, err = readAgeIdentities(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if keys := os.Getenv(env.EnvSOPSAgeKey); keys != "" {
+		sopsIdentities, err := age.ParseIdentities(strings.NewReader(keys))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", env.EnvSOPSAgeKey, err)
+		}
+		return append(identities, sopsIdentities...), nil
+	}
+
+	path := os.Getenv(env.EnvSOPSAgeKeyFile)
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return identities, nil
+		}
+		path = filepath.Join(dir, "sops", "age", "keys.txt")
+		if _, err := os.Stat(path); err != nil {
+			return identities, nil
+		}
+	}
+	sopsIdentities, err := readAgeIdentities(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(identities, sopsIdentities...), nil
+}
+
+// readAgeIdentities reads the age identities in the file at path
+func readAgeIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open age identities: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identities in %s: %w", path, err)
+	}
+	return identities, nil
+}
@@ -0,0 +1,20 @@
+// Package object describes objects fetched from S3, independently of the s3
+// package. This prevents unwanted direct package dependencies, as with
+// sentinel.
+package object
+
+// Info is metadata about a fetched object
+type Info struct {
+	// VersionID is the object's version, if the bucket is versioned
+	VersionID string
+
+	// ETag identifies the object's contents
+	ETag string
+
+	// Metadata is the object's user metadata, keyed without the
+	// x-amz-meta- prefix
+	Metadata map[string]string
+
+	// Tags are the object's tags, if it has any and they could be read
+	Tags map[string]string
+}
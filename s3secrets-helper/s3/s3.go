@@ -1,6 +1,7 @@
 package s3
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/env"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/object"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
 )
 
@@ -110,6 +112,15 @@ func (c *Client) Region() string {
 // sentinel.ErrNotFound and sentinel.ErrForbidden are returned for those cases.
 // Other errors are returned verbatim.
 func (c *Client) Get(key string) ([]byte, error) {
+	data, _, err := c.GetWithInfo(key)
+	return data, err
+}
+
+// GetWithInfo downloads an object from S3 like Get, and also returns its
+// version ID, ETag, user metadata and tags. Tags are only fetched if the
+// object has any, and are left out if they can't be read, as reading them
+// needs s3:GetObjectTagging.
+func (c *Client) GetWithInfo(key string) ([]byte, object.Info, error) {
 	out, err := c.s3.GetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: &c.bucket,
 		Key:    &key,
@@ -117,7 +128,7 @@ func (c *Client) Get(key string) ([]byte, error) {
 	if err != nil {
 		var noSuchKey *types.NoSuchKey
 		if errors.As(err, &noSuchKey) {
-			return nil, sentinel.ErrNotFound
+			return nil, object.Info{}, sentinel.ErrNotFound
 		}
 
 		// Possible values can be found at https://docs.aws.amazon.com/AmazonS3/latest/API/API_Error.html
@@ -125,16 +136,52 @@ func (c *Client) Get(key string) ([]byte, error) {
 		if errors.As(err, &apiErr) {
 			code := apiErr.ErrorCode()
 			if code == "AccessDenied" {
-				return nil, sentinel.ErrForbidden
+				return nil, object.Info{}, sentinel.ErrForbidden
 			}
 		}
 
-		return nil, fmt.Errorf("Could not GetObject (%s) in bucket (%s). Ensure your IAM Identity has s3:GetObject permission for this key and bucket. (%v)", key, c.bucket, err)
+		return nil, object.Info{}, fmt.Errorf("Could not GetObject (%s) in bucket (%s). Ensure your IAM Identity has s3:GetObject permission for this key and bucket. (%v)", key, c.bucket, err)
 	}
 	defer out.Body.Close()
+
+	info := object.Info{
+		VersionID: aws.ToString(out.VersionId),
+		ETag:      aws.ToString(out.ETag),
+		Metadata:  out.Metadata,
+	}
+	if aws.ToInt32(out.TagCount) > 0 {
+		tagging, err := c.s3.GetObjectTagging(context.TODO(), &s3.GetObjectTaggingInput{
+			Bucket:    &c.bucket,
+			Key:       &key,
+			VersionId: out.VersionId,
+		})
+		if err == nil {
+			info.Tags = map[string]string{}
+			for _, tag := range tagging.TagSet {
+				info.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+		}
+	}
+
 	// we probably should return io.Reader or io.ReadCloser rather than []byte,
 	// maybe somebody should refactor that (and all the tests etc) one day.
-	return ioutil.ReadAll(out.Body)
+	data, err := ioutil.ReadAll(out.Body)
+	return data, info, err
+}
+
+// Put uploads an object to S3, encrypted with SSE-KMS as the README asks of
+// secrets, so that it's accepted by buckets with a policy requiring it.
+func (c *Client) Put(key string, data []byte) error {
+	_, err := c.s3.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:               &c.bucket,
+		Key:                  &key,
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not PutObject (%s) in bucket (%s). Ensure your IAM Identity has s3:PutObject permission for this key and bucket. (%v)", key, c.bucket, err)
+	}
+	return nil
 }
 
 // ListSuffix returns a list of keys in the bucket that have the given prefix and suffix.
@@ -0,0 +1,227 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first buildkite-agent versions with the features the helper uses
+var (
+	// agentRedactorVersion added redactor add, including --format json and
+	// reading secrets from stdin
+	agentRedactorVersion = agentVersion{3, 67, 0}
+
+	// agentAnnotateVersion added annotate
+	agentAnnotateVersion = agentVersion{3, 0, 0}
+
+	// agentSecretGetVersion added secret get, for Buildkite secrets
+	agentSecretGetVersion = agentVersion{3, 72, 0}
+)
+
+const (
+	// agentCapabilitiesCache is the file in the cache directory that agent
+	// capabilities are cached in
+	agentCapabilitiesCache = "agent-capabilities.json"
+
+	// agentCapabilitiesCacheVersion is bumped when capabilities are added or
+	// their detection changes, invalidating cached entries
+	agentCapabilitiesCacheVersion = 3
+)
+
+// AgentCapabilities holds detected agent version and capabilities
+type AgentCapabilities struct {
+	// Version is the agent's version, or "unknown"
+	Version string
+
+	// SupportsRedactor is true if the agent has redactor add
+	SupportsRedactor bool
+
+	// SupportsStdin is true if redactor add reads secrets from stdin
+	SupportsStdin bool
+
+	// SupportsAnnotate is true if the agent has annotate
+	SupportsAnnotate bool
+
+	// SupportsSecretGet is true if the agent has secret get
+	SupportsSecretGet bool
+}
+
+// agentVersion is a parsed major.minor.patch version of buildkite-agent
+type agentVersion struct {
+	major, minor, patch int
+}
+
+// parseAgentVersion parses a version like 3.73.0, ignoring any pre-release
+// or build suffix such as -beta.1 or +1234.
+func parseAgentVersion(s string) (agentVersion, bool) {
+	s = strings.TrimPrefix(strings.TrimSuffix(s, ","), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return agentVersion{}, false
+	}
+	var v [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return agentVersion{}, false
+		}
+		v[i] = n
+	}
+	return agentVersion{v[0], v[1], v[2]}, true
+}
+
+func (v agentVersion) atLeast(other agentVersion) bool {
+	if v.major != other.major {
+		return v.major > other.major
+	}
+	if v.minor != other.minor {
+		return v.minor > other.minor
+	}
+	return v.patch >= other.patch
+}
+
+func (v agentVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// cachedAgentCapabilities is an entry in the capabilities cache, valid while
+// the agent binary at Path has the same modification time
+type cachedAgentCapabilities struct {
+	CacheVersion int       `json:"cache_version"`
+	ModTime      time.Time `json:"mod_time"`
+	AgentCapabilities
+}
+
+// detectAgentCapabilities discovers what the buildkite-agent in $PATH
+// supports. Capabilities are cached in cacheDir, keyed by the path and
+// modification time of the agent binary, so that the agent is only run again
+// when it's upgraded.
+func detectAgentCapabilities(log *log.Logger, cacheDir string) (AgentCapabilities, error) {
+	path, err := exec.LookPath("buildkite-agent")
+	if err != nil {
+		return AgentCapabilities{}, ErrAgentNotFound
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return AgentCapabilities{}, ErrAgentNotFound
+	}
+
+	if cacheDir == "" {
+		if userCacheDir, err := os.UserCacheDir(); err == nil {
+			cacheDir = filepath.Join(userCacheDir, "s3secrets-helper")
+		}
+	}
+	cachePath := filepath.Join(cacheDir, agentCapabilitiesCache)
+
+	cache := map[string]cachedAgentCapabilities{}
+	if cacheDir != "" {
+		if data, err := os.ReadFile(cachePath); err == nil {
+			// A corrupt cache is replaced
+			_ = json.Unmarshal(data, &cache)
+		}
+	}
+	if cached, ok := cache[path]; ok &&
+		cached.CacheVersion == agentCapabilitiesCacheVersion &&
+		cached.ModTime.Equal(info.ModTime()) {
+		return cached.AgentCapabilities, nil
+	}
+
+	caps := probeAgentCapabilities(path)
+
+	if cacheDir != "" {
+		cache[path] = cachedAgentCapabilities{
+			CacheVersion:      agentCapabilitiesCacheVersion,
+			ModTime:           info.ModTime(),
+			AgentCapabilities: caps,
+		}
+		if err := writeCacheFile(cacheDir, cachePath, cache); err != nil {
+			log.Printf("Warning: failed to cache buildkite-agent capabilities: %v", err)
+		}
+	}
+	return caps, nil
+}
+
+// probeAgentCapabilities runs the agent at path to find its version, and
+// compares it against the versions that added each feature. If the version
+// can't be parsed, as with development builds, the help for redactor add is
+// checked for the command instead, and secrets are passed in files, as its
+// help doesn't reliably say whether it reads them from stdin. Secret get isn't
+// assumed either, as it was added well after redactor add.
+func probeAgentCapabilities(path string) AgentCapabilities {
+	caps := AgentCapabilities{
+		Version: "unknown",
+	}
+
+	// Extract version from "buildkite-agent version 3.73.0, build 1234"
+	if versionOutput, err := exec.Command(path, "--version").Output(); err == nil {
+		if parts := strings.Fields(string(versionOutput)); len(parts) >= 3 {
+			caps.Version = strings.TrimSuffix(parts[2], ",")
+		}
+	}
+
+	if v, ok := parseAgentVersion(caps.Version); ok {
+		caps.SupportsRedactor = v.atLeast(agentRedactorVersion)
+		caps.SupportsStdin = caps.SupportsRedactor
+		caps.SupportsAnnotate = v.atLeast(agentAnnotateVersion)
+		caps.SupportsSecretGet = v.atLeast(agentSecretGetVersion)
+		return caps
+	}
+
+	// Test if redactor command exists
+	output, err := exec.Command(path, "redactor", "add", "--help").Output()
+	if err != nil {
+		// Command failed completely
+		return caps
+	}
+
+	// Check if the command actually succeeded by looking for redactor-specific content
+	// If "redactor" isn't supported, buildkite-agent shows general help instead
+	helpText := string(output)
+	if !strings.Contains(helpText, "redactor") {
+		return caps
+	}
+	caps.SupportsRedactor = true
+
+	// Every agent with redactor add has annotate
+	caps.SupportsAnnotate = true
+
+	return caps
+}
+
+// writeCacheFile atomically replaces the file at path with v as JSON, so that
+// concurrent jobs never read a partially written cache.
+func writeCacheFile(dir, path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/audit"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/object"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// InfoGetter is implemented by clients that can also return metadata about
+// the objects they fetch, such as *s3.Client
+type InfoGetter interface {
+	GetWithInfo(key string) ([]byte, object.Info, error)
+}
+
+// getWithInfo fetches an object with its metadata, if the client supports it
+func getWithInfo(c Client, key string) ([]byte, object.Info, error) {
+	if ig, ok := c.(InfoGetter); ok {
+		return ig.GetWithInfo(key)
+	}
+	data, err := c.Get(key)
+	return data, object.Info{}, err
+}
+
+// WithAudit returns a client that writes a record of every object fetched
+// through it to sink, identifying the fetch as job's. Failing to write a
+// record is logged as a warning, and doesn't fail the fetch. A nil sink
+// returns c unchanged.
+func WithAudit(c Client, sink audit.Sink, job audit.Job, logger *log.Logger) Client {
+	if sink == nil {
+		return c
+	}
+	return &auditedClient{Client: c, sink: sink, job: job, logger: logger}
+}
+
+// auditedClient writes an audit record for every object fetched through it
+type auditedClient struct {
+	Client
+	sink   audit.Sink
+	job    audit.Job
+	logger *log.Logger
+}
+
+func (c *auditedClient) Get(key string) ([]byte, error) {
+	data, _, err := c.GetWithInfo(key)
+	return data, err
+}
+
+func (c *auditedClient) GetWithInfo(key string) ([]byte, object.Info, error) {
+	data, info, err := getWithInfo(c.Client, key)
+
+	record := audit.Record{
+		Time:      time.Now().UTC(),
+		Bucket:    c.Client.Bucket(),
+		Key:       key,
+		VersionID: info.VersionID,
+		ETag:      info.ETag,
+		Outcome:   audit.OutcomeFetched,
+		Job:       c.job,
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, sentinel.ErrNotFound):
+		record.Outcome = audit.OutcomeNotFound
+	case errors.Is(err, sentinel.ErrForbidden):
+		record.Outcome = audit.OutcomeForbidden
+	default:
+		record.Outcome = audit.OutcomeError
+		record.Error = err.Error()
+	}
+	if werr := c.sink.Write(record); werr != nil {
+		c.logger.Printf("Warning: failed to write audit record for %s/%s: %v", record.Bucket, key, werr)
+	}
+	return data, info, err
+}
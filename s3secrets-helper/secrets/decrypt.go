@@ -0,0 +1,169 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/envelope"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/object"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// decryptTimeout bounds the calls made to decrypt a single object
+const decryptTimeout = 30 * time.Second
+
+// Decrypter decrypts objects stored encrypted, with a suffix such as .enc
+// appended to their keys
+type Decrypter interface {
+	// Suffix is appended to the keys of objects this decrypts
+	Suffix() string
+
+	// Decrypt decrypts the object stored at key plus Suffix, failing if it
+	// wasn't encrypted for key
+	Decrypt(key string, data []byte) ([]byte, error)
+}
+
+// WithDecrypters returns a client that fetches objects encrypted for any of
+// the decrypters in preference to plaintext objects, decrypting them
+// transparently. For example, with an envelope decrypter, getting env returns
+// env.enc decrypted if it exists, otherwise env. Listing returns the keys of
+// encrypted objects without their suffix.
+func WithDecrypters(c Client, decrypters []Decrypter) Client {
+	if len(decrypters) == 0 {
+		return c
+	}
+	return &decryptingClient{Client: c, decrypters: decrypters}
+}
+
+type decryptingClient struct {
+	Client
+	decrypters []Decrypter
+}
+
+func (c *decryptingClient) Get(key string) ([]byte, error) {
+	data, _, err := c.GetWithInfo(key)
+	return data, err
+}
+
+func (c *decryptingClient) GetWithInfo(key string) ([]byte, object.Info, error) {
+	for _, d := range c.decrypters {
+		data, info, err := getWithInfo(c.Client, key+d.Suffix())
+		if errors.Is(err, sentinel.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, info, err
+		}
+		plaintext, err := d.Decrypt(key, data)
+		if err != nil {
+			return nil, info, fmt.Errorf("failed to decrypt %s%s: %w", key, d.Suffix(), err)
+		}
+		return plaintext, info, nil
+	}
+	return getWithInfo(c.Client, key)
+}
+
+func (c *decryptingClient) ListSuffix(prefix string, suffixes []string) ([]string, error) {
+	all := append([]string(nil), suffixes...)
+	for _, d := range c.decrypters {
+		for _, s := range suffixes {
+			all = append(all, s+d.Suffix())
+		}
+	}
+	keys, err := c.Client.ListSuffix(prefix, all)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	seen := map[string]bool{}
+	for _, k := range keys {
+		for _, d := range c.decrypters {
+			if trimmed, ok := strings.CutSuffix(k, d.Suffix()); ok {
+				k = trimmed
+				break
+			}
+		}
+		if !seen[k] {
+			seen[k] = true
+			result = append(result, k)
+		}
+	}
+	return result, nil
+}
+
+// NewEnvelopeDecrypter returns a Decrypter for objects with an .enc suffix,
+// which hold an envelope whose data key is decrypted with kms
+func NewEnvelopeDecrypter(kms envelope.KMS) Decrypter {
+	return &envelopeDecrypter{kms: kms}
+}
+
+type envelopeDecrypter struct {
+	kms envelope.KMS
+}
+
+func (d *envelopeDecrypter) Suffix() string {
+	return envelope.Suffix
+}
+
+func (d *envelopeDecrypter) Decrypt(key string, data []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), decryptTimeout)
+	defer cancel()
+	return envelope.Decrypt(ctx, d.kms, key, data)
+}
+
+// AgeSuffix is appended to the keys of objects encrypted with age
+const AgeSuffix = ".age"
+
+// ageKeyHeader starts the first line of the plaintext of an object encrypted
+// with age, which names the key it was encrypted for, as age has no
+// additional data to bind it to
+const ageKeyHeader = "s3-secrets-key: "
+
+// AgePlaintext prepends the line that binds plaintext to the key it is
+// stored under, without the .age suffix, before it's encrypted with age
+func AgePlaintext(key string, plaintext []byte) []byte {
+	return append([]byte(ageKeyHeader+key+"\n"), plaintext...)
+}
+
+// NewAgeDecrypter returns a Decrypter for objects with an .age suffix, which
+// are encrypted with age to the recipient of one of identities, with a
+// plaintext from AgePlaintext. Both binary and armored files are supported.
+func NewAgeDecrypter(identities []age.Identity) Decrypter {
+	return &ageDecrypter{identities: identities}
+}
+
+type ageDecrypter struct {
+	identities []age.Identity
+}
+
+func (d *ageDecrypter) Suffix() string {
+	return AgeSuffix
+}
+
+func (d *ageDecrypter) Decrypt(key string, data []byte) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		r = armor.NewReader(r)
+	}
+	decrypted, err := age.Decrypt(r, d.identities...)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	line, rest, _ := bytes.Cut(plaintext, []byte("\n"))
+	if string(line) != ageKeyHeader+key {
+		return nil, fmt.Errorf("not encrypted for %s, expected a first line of %q", key, ageKeyHeader+key)
+	}
+	return rest, nil
+}
@@ -0,0 +1,166 @@
+package secrets
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dotenvVar is an assignment in a dotenv file
+type dotenvVar struct {
+	name string
+
+	// value is a template for interpolate if interpolated, otherwise
+	// literal
+	value        string
+	interpolated bool
+
+	// expires is when the variable expires, from an expires comment on
+	// the line before it
+	expires string
+}
+
+// parseDotenv parses a dotenv file. Lines are NAME=value, optionally
+// preceded by export, with # comments. Values may be:
+//
+//   - single quoted, which are literal and may span lines
+//   - double quoted, which may span lines, have \n, \r, \t, \", \\ and \$
+//     escapes, and are interpolated
+//   - unquoted, which end at the end of the line or a # comment after
+//     whitespace, and are interpolated
+//
+// A comment such as # expires: 2026-12-01 gives the expiry of the variable
+// assigned next. Lines that aren't assignments are returned as warnings and
+// ignored, while an unterminated quote is an error.
+func parseDotenv(data []byte) ([]dotenvVar, []string, error) {
+	var vars []dotenvVar
+	var warnings []string
+	s := strings.ReplaceAll(string(data), "\r\n", "\n")
+	line := 1
+	var expires string
+
+	for len(s) > 0 {
+		start := line
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			break
+		}
+		if s[0] == '\n' || s[0] == '#' {
+			comment, _, _ := strings.Cut(strings.TrimLeft(s, "# \t"), "\n")
+			if value, ok := strings.CutPrefix(comment, expiresKey+":"); ok {
+				expires = strings.TrimSpace(value)
+			}
+			s = skipLine(s, &line)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(s, "export "); ok {
+			s = strings.TrimLeft(rest, " \t")
+		}
+
+		n := 0
+		for n < len(s) && isNameChar(s[n], n == 0) {
+			n++
+		}
+		name, rest := s[:n], strings.TrimLeft(s[n:], " \t")
+		if n == 0 || !strings.HasPrefix(rest, "=") {
+			warnings = append(warnings, fmt.Sprintf("line %d is not a NAME=value assignment", start))
+			s = skipLine(s, &line)
+			continue
+		}
+		s = strings.TrimLeft(rest[1:], " \t")
+
+		v := dotenvVar{name: name, expires: expires}
+		expires = ""
+		var err error
+		switch {
+		case strings.HasPrefix(s, "'"):
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return nil, nil, fmt.Errorf("line %d: unterminated single quoted value of %s", start, name)
+			}
+			v.value = s[1 : end+1]
+			line += strings.Count(v.value, "\n")
+			s = s[end+2:]
+		case strings.HasPrefix(s, `"`):
+			if v.value, s, err = parseDoubleQuoted(s[1:], &line); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s of %s", start, err, name)
+			}
+			v.interpolated = true
+		default:
+			end := strings.IndexByte(s, '\n')
+			if end < 0 {
+				end = len(s)
+			}
+			value := s[:end]
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			if i := strings.Index(value, "\t#"); i >= 0 {
+				value = value[:i]
+			}
+			v.value = strings.ReplaceAll(strings.TrimSpace(value), `\$`, "$$")
+			v.interpolated = true
+			s = s[end:]
+		}
+		vars = append(vars, v)
+
+		// anything after a quoted value must be a comment
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != '\n' && s[0] != '#' {
+			warnings = append(warnings, fmt.Sprintf("line %d has unexpected text after the value of %s", line, name))
+		}
+		s = skipLine(s, &line)
+	}
+	return vars, warnings, nil
+}
+
+// parseDoubleQuoted parses the value after an opening double quote up to
+// the closing quote, returning it as a template and the rest of s
+func parseDoubleQuoted(s string, line *int) (string, string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 == len(s) {
+				break
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '$':
+				b.WriteString("$$")
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			if c == '\n' {
+				*line++
+			}
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated double quoted value")
+}
+
+// skipLine returns s after the next newline, counting it in line
+func skipLine(s string, line *int) string {
+	i := strings.IndexByte(s, '\n')
+	if i < 0 {
+		return ""
+	}
+	*line++
+	return s[i+1:]
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
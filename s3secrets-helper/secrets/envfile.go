@@ -0,0 +1,165 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// structuredEnvExtensions are the extensions of env files in JSON or YAML,
+// which are checked for alongside env and environment
+var structuredEnvExtensions = []string{".json", ".yaml"}
+
+// envGroupSeparator joins the keys of nested groups in structured env files
+// into variable names, so {"DATABASE": {"HOST": "db"}} sets DATABASE_HOST
+const envGroupSeparator = "_"
+
+// structuredEnvVar is a variable in a structured env file. secret is nil
+// unless the file flags whether it's a secret, and expires is empty unless
+// the file says when it expires.
+type structuredEnvVar struct {
+	name    string
+	value   string
+	secret  *bool
+	expires string
+}
+
+func isStructuredEnv(key string) bool {
+	return slices.Contains(structuredEnvExtensions, path.Ext(key))
+}
+
+// parseStructuredEnv parses an env file in JSON or YAML, which YAML is a
+// superset of. It's a map of names to either strings, or maps with a string
+// value, a boolean secret flag, and an expiry:
+//
+//	DATABASE_HOST: db.internal
+//	DATABASE_PASSWORD:
+//	  value: hunter2
+//	  secret: true
+//	  expires: 2026-12-01
+//
+// Any other map is a group, whose keys are joined to its name with
+// envGroupSeparator.
+func parseStructuredEnv(data []byte) ([]structuredEnvVar, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	if root.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("expected a map of variables")
+	}
+
+	var vars []structuredEnvVar
+	seen := map[string]bool{}
+	var walk func(n *yaml.Node, prefix string) error
+	walk = func(n *yaml.Node, prefix string) error {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			name, value := prefix+n.Content[i].Value, n.Content[i+1]
+			if value.Kind == yaml.MappingNode && !isStructuredEnvEntry(value) {
+				if err := walk(value, name+envGroupSeparator); err != nil {
+					return err
+				}
+				continue
+			}
+
+			v := structuredEnvVar{name: name}
+			if value.Kind == yaml.MappingNode {
+				var entry struct {
+					Value   yaml.Node `yaml:"value"`
+					Secret  *bool     `yaml:"secret"`
+					Expires string    `yaml:"expires"`
+				}
+				if err := value.Decode(&entry); err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				value, v.secret, v.expires = &entry.Value, entry.Secret, entry.Expires
+			}
+			if value.Kind != yaml.ScalarNode || value.ShortTag() != "!!str" {
+				return fmt.Errorf("%s: expected a string, got %s (quote numbers and booleans)", name, describeYAML(value))
+			}
+			if !isEnvName(name) {
+				return fmt.Errorf("%s: not a valid environment variable name", name)
+			}
+			if seen[name] {
+				return fmt.Errorf("%s: set more than once", name)
+			}
+			seen[name] = true
+			v.value = value.Value
+			vars = append(vars, v)
+		}
+		return nil
+	}
+	if err := walk(root.Content[0], ""); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// isStructuredEnvEntry reports whether n is a map with a value, and
+// optionally a secret flag and an expiry, rather than a group
+func isStructuredEnvEntry(n *yaml.Node) bool {
+	var hasValue bool
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		switch n.Content[i].Value {
+		case "value":
+			hasValue = true
+		case "secret", "expires":
+		default:
+			return false
+		}
+	}
+	return hasValue
+}
+
+// describeYAML describes the type of n for errors
+func describeYAML(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a map"
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.AliasNode:
+		return "an alias"
+	}
+	switch n.ShortTag() {
+	case "!!int", "!!float":
+		return "a number"
+	case "!!bool":
+		return "a boolean"
+	case "!!null":
+		return "null"
+	}
+	return n.ShortTag()
+}
+
+// handleStructuredEnv loads an env file in JSON or YAML. Its values are
+// literal. Variables flagged with secret are redacted or not as flagged, and
+// others by the redaction policy.
+func handleStructuredEnv(conf *Config, r getResult) error {
+	vars, err := parseStructuredEnv(r.data)
+	if err != nil {
+		return err
+	}
+	conf.Logger.Printf("Loading %s/%s (%d bytes) of env", r.bucket, r.key, len(r.data))
+	for _, v := range vars {
+		if v.expires != "" && !checkVarExpiry(conf, r, v.name, v.expires) {
+			continue
+		}
+		conf.envVars = append(conf.envVars, envVar{
+			name:   v.name,
+			value:  v.value,
+			secret: v.secret,
+			kind:   envFileKind,
+			scope:  envScopeOf(conf, envFileKind, r.key),
+			bucket: r.bucket,
+			key:    r.key,
+		})
+	}
+	return nil
+}
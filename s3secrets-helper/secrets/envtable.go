@@ -0,0 +1,112 @@
+package secrets
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// envScope is where a variable was defined. A definition in a later scope
+// takes precedence over one in an earlier scope, whatever order they're
+// loaded in, and within a scope the last definition loaded wins.
+type envScope int
+
+const (
+	rootEnvScope envScope = iota
+	pipelineEnvScope
+	stepEnvScope
+	rootSecretFileScope
+	pipelineSecretFileScope
+	stepSecretFileScope
+)
+
+// envScopeOf returns the scope of a variable of kind loaded from key
+func envScopeOf(conf *Config, kind, key string) envScope {
+	scope := rootEnvScope
+	if kind == secretFileKind {
+		scope = rootSecretFileScope
+	}
+	switch {
+	case conf.StepKey != "" && strings.HasPrefix(key, stepPrefix(conf)+"/"):
+		scope += stepEnvScope - rootEnvScope
+	case strings.HasPrefix(key, conf.Prefix+"/"):
+		scope += pipelineEnvScope - rootEnvScope
+	}
+	return scope
+}
+
+// envTable is the merged table of variables from every scope, ordered by
+// precedence, so the last definition of each name is the one written to the
+// environment
+type envTable struct {
+	vars []envVar
+
+	// last is the index of the last definition of each name
+	last map[string]int
+}
+
+// mergeEnv orders vars by precedence into a table
+func mergeEnv(vars []envVar) *envTable {
+	vars = slices.Clone(vars)
+	slices.SortStableFunc(vars, func(a, b envVar) int {
+		return cmp.Compare(a.scope, b.scope)
+	})
+	t := &envTable{vars: vars, last: map[string]int{}}
+	for i, v := range vars {
+		t.last[v.name] = i
+	}
+	return t
+}
+
+// source describes where the definition at index i was loaded from
+func (t *envTable) source(i int) string {
+	return t.vars[i].bucket + "/" + t.vars[i].key
+}
+
+// reportOverrides warns about variables with a definition that's overridden
+// by a definition from another object, listing where each was loaded from.
+// extends maps a definition that references its own name, as in
+// PATH=$PATH:/bin, to the definition it extends, which isn't overridden.
+func reportOverrides(conf *Config, t *envTable, extends map[int]int) {
+	type override struct {
+		name       string
+		winner     string
+		overridden []string
+	}
+	var overrides []override
+
+	for i, v := range t.vars {
+		if t.last[v.name] != i {
+			continue
+		}
+		used := map[int]bool{i: true}
+		for j, ok := extends[i]; ok; j, ok = extends[j] {
+			used[j] = true
+		}
+		o := override{name: v.name, winner: t.source(i)}
+		for j := range i {
+			// a file that sets a variable twice has done so deliberately
+			if t.vars[j].name != v.name || used[j] || t.vars[j].key == v.key {
+				continue
+			}
+			if source := t.source(j); !slices.Contains(o.overridden, source) {
+				o.overridden = append(o.overridden, source)
+			}
+		}
+		if len(o.overridden) > 0 {
+			overrides = append(overrides, o)
+		}
+	}
+	if len(overrides) == 0 {
+		return
+	}
+
+	var names []string
+	for _, o := range overrides {
+		names = append(names, o.name)
+	}
+	warnf(conf, "Overriding variables defined in more than one place: %s", strings.Join(names, ", "))
+	for _, o := range overrides {
+		conf.Logger.Printf("- %s from %s overrides %s", o.name, o.winner, strings.Join(o.overridden, ", "))
+	}
+}
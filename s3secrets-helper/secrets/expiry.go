@@ -0,0 +1,182 @@
+package secrets
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/object"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// expiresKey names the user metadata (x-amz-meta-expires) or tag of an
+// object, and the comment in an env file, that says when a secret expires
+const expiresKey = "expires"
+
+// DefaultExpiryWarning is how long before a secret expires it's warned
+// about by default
+const DefaultExpiryWarning = 14 * 24 * time.Hour
+
+// parseExpiry parses an RFC 3339 time, or a date, which is the start of
+// that day in UTC
+func parseExpiry(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q, expected a date such as 2006-01-02 or an RFC 3339 time", s)
+}
+
+// objectExpiry returns the expiry in an object's user metadata, or failing
+// that its tags, if it has one
+func objectExpiry(info object.Info) (string, bool) {
+	for _, m := range []map[string]string{info.Metadata, info.Tags} {
+		for k, v := range m {
+			if strings.EqualFold(k, expiresKey) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// expiryChecker collects secrets that have expired or expire soon, to warn
+// about them once everything is loaded, and refuses expired secrets if
+// configured to. Objects are checked as they're fetched, concurrently.
+type expiryChecker struct {
+	window time.Duration
+	refuse bool
+	now    time.Time
+
+	mu       sync.Mutex
+	expiring []expiringSecret
+	invalid  []string
+}
+
+// expiringSecret is a secret that has expired or expires within the window
+type expiringSecret struct {
+	source  string
+	expires time.Time
+}
+
+func newExpiryChecker(conf *Config) *expiryChecker {
+	window := conf.ExpiryWarning
+	if window == 0 {
+		window = DefaultExpiryWarning
+	}
+	return &expiryChecker{window: window, refuse: conf.RefuseExpired, now: time.Now()}
+}
+
+// check records that source expires at expires, if that's within the
+// window. If it has expired and expired secrets are refused, it returns an
+// error wrapping sentinel.ErrExpired instead.
+func (c *expiryChecker) check(source string, expires time.Time) error {
+	if expires.Sub(c.now) > c.window {
+		return nil
+	}
+	if !expires.After(c.now) && c.refuse {
+		return fmt.Errorf("%w on %s", sentinel.ErrExpired, expires.Format(time.RFC3339))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expiring = append(c.expiring, expiringSecret{source: source, expires: expires})
+	return nil
+}
+
+// invalidf records an expiry that couldn't be parsed
+func (c *expiryChecker) invalidf(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalid = append(c.invalid, fmt.Sprintf(format, args...))
+}
+
+// report warns about every secret that has expired or expires within the
+// window, soonest first
+func (c *expiryChecker) report(conf *Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slices.Sort(c.invalid)
+	for _, msg := range c.invalid {
+		warnf(conf, "%s", msg)
+	}
+	slices.SortFunc(c.expiring, func(a, b expiringSecret) int {
+		return cmp.Or(a.expires.Compare(b.expires), cmp.Compare(a.source, b.source))
+	})
+	for _, e := range c.expiring {
+		date := e.expires.Format(time.RFC3339)
+		if e.expires.After(c.now) {
+			warnf(conf, "%s expires in %s, on %s", e.source, formatDays(e.expires.Sub(c.now)), date)
+		} else {
+			warnf(conf, "%s expired %s ago, on %s", e.source, formatDays(c.now.Sub(e.expires)), date)
+		}
+	}
+}
+
+// formatDays describes d in whole days
+func formatDays(d time.Duration) string {
+	switch days := int(d.Hours() / 24); days {
+	case 0:
+		return "less than a day"
+	case 1:
+		return "1 day"
+	default:
+		return fmt.Sprintf("%d days", days)
+	}
+}
+
+// checkVarExpiry checks the expiry of the variable name in the env file r,
+// given by a comment, returning whether to load it
+func checkVarExpiry(conf *Config, r getResult, name, value string) bool {
+	if conf.expiry == nil {
+		return true
+	}
+	source := fmt.Sprintf("%s in %s/%s", name, r.bucket, r.key)
+	expires, err := parseExpiry(value)
+	if err != nil {
+		warnf(conf, "Ignoring the expiry of %s: %v", source, err)
+		return true
+	}
+	if err := conf.expiry.check(source, expires); err != nil {
+		warnf(conf, "Ignoring %s: %v", source, err)
+		return false
+	}
+	return true
+}
+
+// expiringClient checks the expiry of every object fetched through it
+type expiringClient struct {
+	Client
+	checker *expiryChecker
+}
+
+func (c *expiringClient) Get(key string) ([]byte, error) {
+	data, _, err := c.GetWithInfo(key)
+	return data, err
+}
+
+func (c *expiringClient) GetWithInfo(key string) ([]byte, object.Info, error) {
+	data, info, err := getWithInfo(c.Client, key)
+	if err != nil {
+		return data, info, err
+	}
+	value, ok := objectExpiry(info)
+	if !ok {
+		return data, info, nil
+	}
+	source := c.Client.Bucket() + "/" + key
+	expires, err := parseExpiry(value)
+	if err != nil {
+		c.checker.invalidf("Ignoring the expiry of %s: %v", source, err)
+		return data, info, nil
+	}
+	if err := c.checker.check(source, expires); err != nil {
+		return nil, info, err
+	}
+	return data, info, nil
+}
@@ -0,0 +1,17 @@
+package secrets
+
+// SecretsToRedact exposes the secrets collected for redaction to tests.
+func SecretsToRedact(conf *Config) []string {
+	return conf.secretsToRedact
+}
+
+// PipelineSecretFilesAllowed exposes the step-only check to tests, which can
+// call it without Run to check that it doesn't need a summary.
+func PipelineSecretFilesAllowed(conf *Config) bool {
+	return pipelineSecretFilesAllowed(conf)
+}
+
+// ProbeAgentCapabilities exposes agent feature detection to tests.
+func ProbeAgentCapabilities(path string) AgentCapabilities {
+	return probeAgentCapabilities(path)
+}
@@ -0,0 +1,132 @@
+package secrets
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/githubapp"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+const (
+	// githubAppIDKey holds the ID of a GitHub App, within a scope
+	githubAppIDKey = "github-app/app-id"
+
+	// githubAppPrivateKeyKey holds the private key of a GitHub App, within a
+	// scope
+	githubAppPrivateKeyKey = "github-app/private-key.pem"
+)
+
+func getGitHubApp(conf Config, results chan<- getResult) {
+	var keys []string
+	for _, scope := range gitHubAppScopes(conf) {
+		keys = append(keys, scope+githubAppIDKey, scope+githubAppPrivateKeyKey)
+	}
+	conf.Logger.Printf("Checking S3 for a GitHub App:")
+	for _, k := range keys {
+		conf.Logger.Printf("- %s", k)
+	}
+	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
+}
+
+// gitHubAppScopes returns the key prefixes a GitHub App is looked for under,
+// most specific first
+func gitHubAppScopes(conf Config) []string {
+	return []string{conf.Prefix + "/", ""}
+}
+
+// handleGitHubApp registers a credential helper that mints installation
+// tokens for the repository being built, if a GitHub App is stored in the
+// bucket. The pipeline's App is used in preference to the root App.
+//
+// The App is checked here so that a misconfiguration fails the job up front,
+// but tokens are only minted when git asks for credentials.
+func handleGitHubApp(conf *Config, results <-chan getResult) error {
+	found := map[string]getResult{}
+	for r := range results {
+		if r.err != nil {
+			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
+				warnf(conf, "Failed to download %s/%s: %v", r.bucket, r.key, r.err)
+			}
+			conf.summary.skipDownload("GitHub App", r)
+			continue
+		}
+		found[r.key] = r
+	}
+
+	for _, scope := range gitHubAppScopes(*conf) {
+		idKey, keyKey := scope+githubAppIDKey, scope+githubAppPrivateKeyKey
+		id, hasID := found[idKey]
+		key, hasKey := found[keyKey]
+		switch {
+		case hasID && hasKey:
+			return registerGitHubApp(conf, id, key)
+		case hasID:
+			warnf(conf, "Found %s/%s but not %s/%s, ignoring GitHub App", conf.Bucket, idKey, conf.Bucket, keyKey)
+			conf.summary.skip("GitHub App", idKey, "no private key")
+		case hasKey:
+			warnf(conf, "Found %s/%s but not %s/%s, ignoring GitHub App", conf.Bucket, keyKey, conf.Bucket, idKey)
+			conf.summary.skip("GitHub App", keyKey, "no app ID")
+		}
+	}
+	return nil
+}
+
+func registerGitHubApp(conf *Config, id, key getResult) error {
+	log := conf.Logger
+	appID := strings.TrimSpace(string(id.data))
+	if appID == "" || strings.ContainsAny(appID, " \t\r\n'\"\\") {
+		return fmt.Errorf("invalid GitHub App ID in %s/%s", id.bucket, id.key)
+	}
+	if _, err := githubapp.ParsePrivateKey(key.data); err != nil {
+		return fmt.Errorf("invalid GitHub App private key in %s/%s: %w", key.bucket, key.key, err)
+	}
+
+	owner, repo, err := githubapp.ParseRepo(conf.Repo)
+	if err != nil {
+		warnf(conf, "Not using GitHub App %s: %v", appID, err)
+		conf.summary.skip("GitHub App", path.Dir(id.key), err.Error())
+		return nil
+	}
+
+	apiURL := conf.GitHubAPIURL
+	if apiURL == "" {
+		apiURL = githubapp.DefaultAPIURL
+	}
+	host, err := githubapp.HostForAPI(apiURL)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(apiURL, " '\"\\") {
+		return fmt.Errorf("invalid GitHub API URL %q", apiURL)
+	}
+
+	// Tokens are cached in the job directory, which must exist by the time
+	// git first asks for credentials
+	if _, err := jobDirectory(conf); err != nil {
+		return err
+	}
+
+	log.Printf("Adding GitHub App %s in %s/%s as a credential helper for https://%s/%s/%s", appID, id.bucket, path.Dir(id.key), host, owner, repo)
+
+	// Replace spaces ' ' in the helper path with an escaped space '\ '
+	escapedCredentialHelper := strings.ReplaceAll(conf.GitCredentialHelper, " ", "\\ ")
+
+	helper := fmt.Sprintf("%s --github-app=%s/%s --github-api-url=%s %s %s %s",
+		escapedCredentialHelper, owner, repo, apiURL, id.bucket, conf.Client.Region(), path.Dir(id.key))
+
+	// The helper is registered for the repository alone, with its path sent,
+	// so that it doesn't shadow credentials for other repositories on the
+	// host, such as submodules. git matches paths at / boundaries, so the
+	// URL with .git is registered too.
+	base := fmt.Sprintf("https://%s/%s/%s", host, owner, repo)
+	for _, url := range []string{base, base + ".git"} {
+		conf.gitConfig = append(conf.gitConfig,
+			fmt.Sprintf("credential.%s.helper=%s", url, helper),
+			fmt.Sprintf("credential.%s.useHttpPath=true", url),
+		)
+	}
+	conf.summary.load("GitHub App", path.Dir(id.key), fmt.Sprintf("app %s for %s/%s/%s", appID, host, owner, repo))
+	return nil
+}
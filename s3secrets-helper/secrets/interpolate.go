@@ -0,0 +1,288 @@
+package secrets
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// envVar is a variable loaded from an env file or a secret file. Variables
+// are collected from every scope, then interpolated and written to the
+// environment together, so references don't depend on the order scopes are
+// loaded in.
+type envVar struct {
+	name string
+
+	// value is a template for interpolate if interpolated, otherwise
+	// literal
+	value        string
+	interpolated bool
+
+	// secret forces the value to be redacted or not. If nil, the redaction
+	// policy decides.
+	secret *bool
+
+	// kind and key describe where the variable was loaded from
+	kind, bucket, key string
+
+	// scope decides which definition of a name takes precedence
+	scope envScope
+}
+
+// resolvedVar is an envVar after interpolation
+type resolvedVar struct {
+	value  string
+	redact bool
+	reason string
+}
+
+// interpolator resolves references between variables. A reference is to
+// the last definition of a variable, except a reference to a variable's own
+// name, which is to its previous definition, so PATH=$PATH:/bin appends to
+// the PATH from an earlier scope or the job environment.
+type interpolator struct {
+	conf *Config
+	*envTable
+
+	// extends maps a definition that references its own name to the
+	// previous definition
+	extends map[int]int
+
+	resolved []*resolvedVar
+	visiting []bool
+	stack    []int
+}
+
+// lookupEnv looks up a variable in the job environment
+func (conf *Config) lookupEnv(name string) (string, bool) {
+	if conf.LookupEnv != nil {
+		return conf.LookupEnv(name)
+	}
+	return os.LookupEnv(name)
+}
+
+// resolve interpolates the definition at index i, and decides whether to
+// redact it
+func (in *interpolator) resolve(i int) (*resolvedVar, error) {
+	if r := in.resolved[i]; r != nil {
+		return r, nil
+	}
+	v := in.vars[i]
+	if in.visiting[i] {
+		var names []string
+		for _, j := range in.stack[slices.Index(in.stack, i):] {
+			names = append(names, in.vars[j].name)
+		}
+		return nil, fmt.Errorf("%s from %s/%s has a cyclic reference: %s -> %s", v.name, v.bucket, v.key, strings.Join(names, " -> "), v.name)
+	}
+	in.visiting[i] = true
+	in.stack = append(in.stack, i)
+	defer func() {
+		in.visiting[i] = false
+		in.stack = in.stack[:len(in.stack)-1]
+	}()
+
+	r := &resolvedVar{value: v.value}
+	var referencesSecret string
+	if v.interpolated {
+		value, err := interpolate(v.value, func(name string) (string, bool, error) {
+			j, ok := in.last[name]
+			if name == v.name {
+				ok = false
+				for k := i - 1; k >= 0; k-- {
+					if in.vars[k].name == name {
+						j, ok = k, true
+						in.extends[i] = k
+						break
+					}
+				}
+			}
+			if !ok {
+				value, ok := in.conf.lookupEnv(name)
+				return value, ok, nil
+			}
+			ref, err := in.resolve(j)
+			if err != nil {
+				return "", false, err
+			}
+			if ref.redact && referencesSecret == "" {
+				referencesSecret = name
+			}
+			return ref.value, true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s from %s/%s: %w", v.name, v.bucket, v.key, err)
+		}
+		r.value = value
+	}
+
+	switch {
+	case referencesSecret != "":
+		r.redact, r.reason = r.value != "", "references "+referencesSecret
+	case v.secret != nil:
+		r.redact, r.reason = *v.secret && r.value != "", fmt.Sprintf("secret: %t", *v.secret)
+	default:
+		r.redact, r.reason = shouldRedactEnv(in.conf, v.name, r.value)
+	}
+	in.resolved[i] = r
+	return r, nil
+}
+
+// interpolate expands references in template: ${NAME}, $NAME, and
+// ${NAME:-default}, which uses default if NAME is unset or empty. $$ is a
+// literal $, as is a $ that doesn't start a reference. lookup returns the
+// value of a variable, and whether it's set.
+func interpolate(template string, lookup func(name string) (string, bool, error)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '$' || i+1 == len(template) {
+			b.WriteByte(c)
+			continue
+		}
+		next := template[i+1]
+		switch {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			end, depth := -1, 0
+			for j := i + 1; j < len(template) && end < 0; j++ {
+				switch template[j] {
+				case '{':
+					depth++
+				case '}':
+					if depth--; depth == 0 {
+						end = j
+					}
+				}
+			}
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", template)
+			}
+			name, fallback, hasFallback := strings.Cut(template[i+2:end], ":-")
+			if !isEnvName(name) {
+				return "", fmt.Errorf("invalid reference ${%s}", template[i+2:end])
+			}
+			value, ok, err := lookup(name)
+			if err != nil {
+				return "", err
+			}
+			if hasFallback && value == "" {
+				if value, err = interpolate(fallback, lookup); err != nil {
+					return "", err
+				}
+			} else if !ok {
+				return "", fmt.Errorf("references undefined variable %s", name)
+			}
+			b.WriteString(value)
+			i = end
+		case isNameChar(next, true):
+			end := i + 1
+			for end < len(template) && isNameChar(template[end], false) {
+				end++
+			}
+			name := template[i+1 : end]
+			value, ok, err := lookup(name)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return "", fmt.Errorf("references undefined variable %s", name)
+			}
+			b.WriteString(value)
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// writeEnv merges the variables loaded from every scope, interpolates and
+// redacts them, and writes the definition of each that takes precedence to
+// the environment, single quoted so the shell doesn't interpret them again
+func writeEnv(conf *Config) error {
+	if len(conf.envVars) == 0 {
+		return nil
+	}
+	table := mergeEnv(conf.envVars)
+	in := &interpolator{
+		conf:     conf,
+		envTable: table,
+		extends:  map[int]int{},
+		resolved: make([]*resolvedVar, len(table.vars)),
+		visiting: make([]bool, len(table.vars)),
+	}
+
+	type fileSummary struct {
+		kind, key         string
+		count, redactions int
+	}
+	var files []*fileSummary
+	byKey := map[string]*fileSummary{}
+
+	var lines strings.Builder
+	for i, v := range table.vars {
+		var f *fileSummary
+		if v.kind == envFileKind {
+			if f = byKey[v.key]; f == nil {
+				f = &fileSummary{kind: v.kind, key: v.key}
+				byKey[v.key] = f
+				files = append(files, f)
+			}
+			f.count++
+		}
+
+		// Only the definition that takes precedence is resolved, along with
+		// any it references, so an overridden one may reference anything
+		if in.last[v.name] != i {
+			continue
+		}
+		if slices.Contains(conf.managedVars, v.name) {
+			warnf(conf, "Ignoring %s from %s/%s, as it's set by the plugin", v.name, v.bucket, v.key)
+			continue
+		}
+		r, err := in.resolve(i)
+		if err != nil {
+			return fmt.Errorf("failed to interpolate env: %w", err)
+		}
+		if conf.Debug {
+			conf.Logger.Printf("Debug: %s from %s/%s redacted=%t (%s)", v.name, v.bucket, v.key, r.redact, r.reason)
+		}
+		if f != nil && r.redact {
+			f.redactions++
+		}
+		if r.redact {
+			redactSecretVariants(conf, r.value)
+		}
+		lines.WriteString(v.name + "=" + shellQuote(r.value) + "\n")
+	}
+
+	reportOverrides(conf, table, in.extends)
+	for _, f := range files {
+		conf.summary.load(f.kind, f.key, fmt.Sprintf("%d variables, %d redacted", f.count, f.redactions))
+	}
+	if _, err := io.WriteString(conf.EnvSink, lines.String()); err != nil {
+		return fmt.Errorf("failed to write environment data")
+	}
+	return nil
+}
+
+// setManagedEnv records env, which sets the variables names that the plugin
+// manages, to be written by writeManagedEnv
+func setManagedEnv(conf *Config, env string, names ...string) {
+	conf.managedEnv = append(conf.managedEnv, env)
+	conf.managedVars = append(conf.managedVars, names...)
+}
+
+// writeManagedEnv writes the variables the plugin manages, after those from
+// env files, so that an env file can't override them
+func writeManagedEnv(conf *Config) error {
+	if _, err := io.WriteString(conf.EnvSink, strings.Join(conf.managedEnv, "")); err != nil {
+		return fmt.Errorf("failed to write environment data")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/env"
+)
+
+// tmpfsDir is preferred for the job directory, so that the secrets written to
+// it are kept in memory rather than on disk
+const tmpfsDir = "/dev/shm"
+
+// jobDirectory returns the directory holding files written for this job,
+// creating it on first use. The directory is private to the agent user and its
+// path is exported so that the pre-exit hook can remove it.
+func jobDirectory(conf *Config) (string, error) {
+	if conf.jobDir != "" {
+		return conf.jobDir, nil
+	}
+	var dir string
+	var err error
+	if conf.TempDir != "" {
+		dir, err = os.MkdirTemp(conf.TempDir, "s3-secrets-")
+	} else if dir, err = os.MkdirTemp(tmpfsDir, "s3-secrets-"); err != nil {
+		// Not Linux, or /dev/shm isn't mounted or writable
+		dir, err = os.MkdirTemp("", "s3-secrets-")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create job directory: %w", err)
+	}
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to set permissions on job directory: %w", err)
+	}
+	setManagedEnv(conf, env.EnvJobDir+"="+shellQuote(dir)+"\n", env.EnvJobDir)
+	conf.jobDir = dir
+	return dir, nil
+}
+
+// writeJobFile writes data to a file in the job directory, readable only by
+// the agent user, and returns its path.
+func writeJobFile(conf *Config, name string, data []byte) (string, error) {
+	dir, err := jobDirectory(conf)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// shellQuote single-quotes a value so that it is taken literally when the
+// hook evaluates the environment.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
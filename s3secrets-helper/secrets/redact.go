@@ -0,0 +1,275 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/env"
+)
+
+// redactionVariants returns the forms a secret is commonly printed in by
+// other tools, other than the secret itself: escaped for Go or JSON strings,
+// percent-encoded for URLs, and base64 encoded.
+//
+// Base64 is registered as base64Variants, so that it's redacted wherever the
+// secret is in a longer encoded value.
+func redactionVariants(value string) []string {
+	var variants []string
+
+	quoted := strconv.Quote(value)
+	variants = append(variants, quoted[1:len(quoted)-1])
+
+	var escaped bytes.Buffer
+	encoder := json.NewEncoder(&escaped)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err == nil {
+		// Encode adds quotes and a trailing newline
+		escapedValue := strings.TrimSuffix(escaped.String(), "\n")
+		variants = append(variants, escapedValue[1:len(escapedValue)-1])
+	}
+
+	variants = append(variants, url.QueryEscape(value), url.PathEscape(value))
+
+	return append(variants, base64Variants(value)...)
+}
+
+// minBase64Variant is the length of the shortest base64 variant registered,
+// as shorter fragments of a short secret would redact unrelated text
+const minBase64Variant = 4
+
+// base64Variants returns the base64 encodings, standard and URL-safe, of a
+// secret at each of the 3 byte offsets it can start at in a longer encoded
+// value, such as a docker auth of user:secret. At each offset, the secret is
+// encoded after that many leading bytes, and the characters that depend on
+// the bytes before and after it are trimmed, leaving those that are the same
+// wherever it's encoded at that offset. Without padding, these are
+// substrings of both padded and unpadded encodings.
+func base64Variants(value string) []string {
+	var variants []string
+	for offset := range 3 {
+		padded := append(make([]byte, offset), value...)
+		padded = padded[:len(padded)/3*3]
+		// Each leading byte affects the character after the ones it's in
+		skip := 0
+		if offset > 0 {
+			skip = offset + 1
+		}
+		for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+			encoded := encoding.EncodeToString(padded)
+			if len(encoded)-skip < minBase64Variant {
+				continue
+			}
+			if variant := encoded[skip:]; !slices.Contains(variants, variant) {
+				variants = append(variants, variant)
+			}
+		}
+	}
+	return variants
+}
+
+// redactSecretVariants registers a secret for redaction along with its
+// redactionVariants. Variants that are too large are dropped silently, as
+// the secret itself is reported if it's too large.
+func redactSecretVariants(conf *Config, value string) {
+	if value == "" {
+		return
+	}
+	redactSecret(conf, value)
+	if len(value) >= MaxSecretSize {
+		return
+	}
+	for _, variant := range redactionVariants(value) {
+		if variant != value && len(variant) < MaxSecretSize {
+			redactSecret(conf, variant)
+		}
+	}
+}
+
+// redactBasicAuth registers the base64 encoded user:password pair that is
+// sent in an HTTP Basic Authorization header, as printed by tools that trace
+// HTTP requests or write docker config files.
+func redactBasicAuth(conf *Config, username, password string) {
+	if password == "" {
+		return
+	}
+	encoded := base64.RawStdEncoding.EncodeToString([]byte(username + ":" + password))
+	if len(encoded) < MaxSecretSize {
+		redactSecret(conf, encoded)
+	}
+}
+
+// EnvRedaction is a policy for which values in env files are redacted
+type EnvRedaction string
+
+const (
+	// EnvRedactionSuffix redacts values whose names contain one of the
+	// secret suffixes, such as _PASSWORD or _TOKEN
+	EnvRedactionSuffix EnvRedaction = "suffix"
+
+	// EnvRedactionAll redacts values matched by EnvRedactionSuffix, plus
+	// every value at least as long as the minimum length
+	EnvRedactionAll EnvRedaction = "all"
+
+	// EnvRedactionEntropy redacts values matched by EnvRedactionSuffix, plus
+	// values at least as long as the minimum length that look random
+	EnvRedactionEntropy EnvRedaction = "entropy"
+
+	// DefaultEnvRedactionMinLength is the default length below which values
+	// are only redacted if their names have a secret suffix
+	DefaultEnvRedactionMinLength = 6
+
+	// envRedactionEntropyThreshold is the Shannon entropy, in bits per
+	// character, above which EnvRedactionEntropy considers a value random.
+	// Words, regions and version numbers fall below it, while most URLs,
+	// keys and tokens are above it.
+	envRedactionEntropyThreshold = 3.5
+)
+
+// ParseEnvRedaction parses an EnvRedaction policy, defaulting to
+// EnvRedactionSuffix if s is empty
+func ParseEnvRedaction(s string) (EnvRedaction, error) {
+	switch policy := EnvRedaction(strings.ToLower(s)); policy {
+	case "":
+		return EnvRedactionSuffix, nil
+	case EnvRedactionSuffix, EnvRedactionAll, EnvRedactionEntropy:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown env redaction policy %q, expected %q, %q or %q", s, EnvRedactionSuffix, EnvRedactionAll, EnvRedactionEntropy)
+	}
+}
+
+// shouldRedactEnv decides whether the value of an env file variable is
+// redacted under the configured policy, with the reason for the decision.
+// The reason never includes the value.
+func shouldRedactEnv(conf *Config, key, value string) (bool, string) {
+	if value == "" {
+		return false, "empty"
+	}
+	if slices.Contains(conf.EnvRedactionAllowlist, key) {
+		return false, "allowlisted"
+	}
+
+	minLength := conf.EnvRedactionMinLength
+	if minLength <= 0 {
+		minLength = DefaultEnvRedactionMinLength
+	}
+
+	policy := conf.EnvRedaction
+	if policy == "" {
+		policy = EnvRedactionSuffix
+	}
+
+	if isSecretVar(key) {
+		return true, "name has a secret suffix"
+	}
+	switch policy {
+	case EnvRedactionAll:
+		if len(value) < minLength {
+			return false, fmt.Sprintf("shorter than %d characters", minLength)
+		}
+		return true, "all values are redacted"
+	case EnvRedactionEntropy:
+		if len(value) < minLength {
+			return false, fmt.Sprintf("shorter than %d characters", minLength)
+		}
+		entropy := shannonEntropy(value)
+		if entropy < envRedactionEntropyThreshold {
+			return false, fmt.Sprintf("entropy %.2f bits/char is below %.2f", entropy, envRedactionEntropyThreshold)
+		}
+		return true, fmt.Sprintf("entropy %.2f bits/char", entropy)
+	default:
+		return false, "name has no secret suffix"
+	}
+}
+
+// shannonEntropy returns the Shannon entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	var entropy float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+var (
+	// ErrAgentNotFound indicates that buildkite-agent isn't in $PATH, so
+	// secrets can't be redacted
+	ErrAgentNotFound = errors.New("buildkite-agent not found")
+
+	// ErrRedactorUnsupported indicates that buildkite-agent is too old to
+	// support redactor add
+	ErrRedactorUnsupported = errors.New("buildkite-agent doesn't support redactor add")
+)
+
+// agentRedactor adds secrets to the redactor with buildkite-agent redactor add
+type agentRedactor struct {
+	log *log.Logger
+
+	// cacheDir caches the agent's capabilities between jobs
+	cacheDir string
+
+	// dir returns a private directory for agents that can't read secrets
+	// from stdin
+	dir func() (string, error)
+}
+
+func (r *agentRedactor) Redact(secrets []string) error {
+	return redactSecrets(r.log, secrets, r.cacheDir, r.dir)
+}
+
+// NewAgentRedactor returns a Redactor that runs buildkite-agent redactor
+// add, for use outside Run, such as by the git credential helper. Agents
+// that can't read secrets from stdin are passed a file in jobDir.
+func NewAgentRedactor(log *log.Logger, cacheDir, jobDir string) Redactor {
+	return &agentRedactor{
+		log:      log,
+		cacheDir: cacheDir,
+		dir: func() (string, error) {
+			if jobDir == "" {
+				return "", fmt.Errorf("%s is not set", env.EnvJobDir)
+			}
+			return jobDir, nil
+		},
+	}
+}
+
+// handleUnredactedSecrets is called when secrets couldn't be added to the
+// redactor. It fails if redaction is required, otherwise it warns that the
+// secrets will appear unredacted in the job log.
+func handleUnredactedSecrets(conf *Config, redactErr error) error {
+	if conf.RequireRedaction {
+		return fmt.Errorf("refusing to continue with %d secrets that can't be redacted: %w", len(conf.secretsToRedact), redactErr)
+	}
+	warnf(conf, "Failed to add secrets to redactor: %v", redactErr)
+	warnf(conf, "Secrets will appear unredacted in logs; upgrade buildkite-agent or set BUILDKITE_PLUGIN_S3_SECRETS_REQUIRE_REDACTION to fail instead")
+	return nil
+}
+
+// isEnvName reports whether name is a valid shell variable name
+func isEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,18 +2,29 @@ package secrets
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/audit"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/gitcredential"
 	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
-	"github.com/joho/godotenv"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/signature"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sops"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sshagent"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
@@ -49,11 +60,16 @@ type Client interface {
 // Agent represents interaction with an ssh-agent process
 type Agent interface {
 	Run() (bool, error)
-	Add(key []byte) error
+	Add(key sshagent.Key) error
 	Pid() int
 	Stdout() io.Reader
 }
 
+// Redactor adds secrets to the redactor of the job's log output
+type Redactor interface {
+	Redact(secrets []string) error
+}
+
 // All functions use *Config (pointer receivers) because we accumulate secrets in secretsToRedact across multiple handler functions,
 // which avoids copying struct containing 3 interfaces (Client, Agent, io.Writer) and 2 slices and maintains consistent API - all handlers can modify shared state
 type Config struct {
@@ -86,12 +102,137 @@ type Config struct {
 	// Defaults to "_SECRET", "_SECRET_KEY", "_PASSWORD", "_TOKEN", and "_ACCESS_KEY"
 	SecretSuffixes []string
 
+	// EnvRedaction is the policy for which values in env files are redacted,
+	// from BUILDKITE_PLUGIN_S3_SECRETS_ENV_REDACTION.
+	// Defaults to EnvRedactionSuffix
+	EnvRedaction EnvRedaction
+
+	// EnvRedactionMinLength is the length below which env file values are
+	// only redacted if their names have a secret suffix, from
+	// BUILDKITE_PLUGIN_S3_SECRETS_ENV_REDACTION_MIN_LENGTH.
+	// Defaults to DefaultEnvRedactionMinLength
+	EnvRedactionMinLength int
+
+	// EnvRedactionAllowlist names env file variables that are never
+	// redacted, from BUILDKITE_PLUGIN_S3_SECRETS_ENV_REDACTION_ALLOWLIST
+	EnvRedactionAllowlist []string
+
+	// Redactor adds secrets to the job's log redactor.
+	// Defaults to running buildkite-agent redactor add
+	Redactor Redactor
+
+	// RequireRedaction fails the job if any secrets can't be redacted,
+	// including secrets larger than MaxSecretSize, rather than warning, from
+	// BUILDKITE_PLUGIN_S3_SECRETS_REQUIRE_REDACTION
+	RequireRedaction bool
+
+	// Debug enables logging of decisions such as which variables are
+	// redacted, from BUILDKITE_PLUGIN_S3_SECRETS_DEBUG
+	Debug bool
+
 	// SkipSSHKeyNotFoundWarning suppresses the warning when no SSH key is found
 	// Defaults to false
 	SkipSSHKeyNotFoundWarning bool
 
+	// GitHubAPIURL is the GitHub REST API used to mint GitHub App tokens,
+	// from BUILDKITE_PLUGIN_S3_SECRETS_GITHUB_API_URL.
+	// Defaults to https://api.github.com
+	GitHubAPIURL string
+
+	// TempDir is where the per-job directory for files such as known_hosts is
+	// created. Defaults to /dev/shm if available, so that files are kept in
+	// memory, otherwise os.TempDir()
+	TempDir string
+
+	// Annotate adds an annotation summarising what was loaded to the build,
+	// from BUILDKITE_PLUGIN_S3_SECRETS_ANNOTATE
+	Annotate bool
+
+	// Annotator adds the annotation.
+	// Defaults to running buildkite-agent annotate
+	Annotator Annotator
+
+	// JobID from BUILDKITE_JOB_ID, used to give each job's annotation its
+	// own context
+	JobID string
+
+	// Decrypters decrypt objects stored encrypted, which are used in
+	// preference to plaintext objects
+	Decrypters []Decrypter
+
+	// LookupEnv looks up variables in the job environment, which env files
+	// can reference. Defaults to os.LookupEnv
+	LookupEnv func(name string) (string, bool)
+
+	// SOPSKeys decrypt env files encrypted with SOPS
+	SOPSKeys sops.Keys
+
+	// TrustedKeys, if set, must have signed every object loaded, with the
+	// signature in a companion object with a .sig suffix
+	TrustedKeys []signature.PublicKey
+
+	// ExpiryWarning is how long before a secret expires to warn about it,
+	// from BUILDKITE_PLUGIN_S3_SECRETS_EXPIRY_WARNING_DAYS.
+	// Defaults to DefaultExpiryWarning
+	ExpiryWarning time.Duration
+
+	// RefuseExpired skips secrets that have expired, rather than loading
+	// them with a warning, from BUILDKITE_PLUGIN_S3_SECRETS_REFUSE_EXPIRED
+	RefuseExpired bool
+
+	// StepKey from BUILDKITE_STEP_KEY adds a scope of env files and secret
+	// files for the step, under Prefix/steps/StepKey
+	StepKey string
+
+	// StepOnly skips the pipeline's secret files, under
+	// Prefix/secret-files, unless StepKey is listed in the pipeline's step
+	// allowlist, from BUILDKITE_PLUGIN_S3_SECRETS_STEP_ONLY
+	StepOnly bool
+
+	// Audit receives a record of every object fetched, if set
+	Audit audit.Sink
+
+	// AuditJob identifies the job in audit records
+	AuditJob audit.Job
+
+	// CacheDir is where state shared between jobs, such as the capabilities
+	// of buildkite-agent, is cached, from BUILDKITE_PLUGIN_S3_SECRETS_CACHE_DIR.
+	// Defaults to a directory in os.UserCacheDir()
+	CacheDir string
+
+	// jobDir is the per-job directory, created on first use
+	jobDir string
+
+	// knownHostsFile is the downloaded known_hosts in the job directory, if
+	// there is one
+	knownHostsFile string
+
+	// sshIdentities are loaded keys pinned to specific hosts or repositories
+	sshIdentities []sshIdentity
+
+	// gitConfig collects entries for GIT_CONFIG_PARAMETERS
+	gitConfig []string
+
 	// secretsToRedact collects all secrets to redact in a single batch
 	secretsToRedact []string
+
+	// summary collects what was loaded for the annotation
+	summary *summary
+
+	// expiry collects secrets that expire soon
+	expiry *expiryChecker
+
+	// oversizedSecrets counts secrets too large to be redacted
+	oversizedSecrets int
+
+	// envVars collects the variables from env files and secret files, to be
+	// interpolated and written once all are loaded
+	envVars []envVar
+
+	// managedEnv collects the lines setting variables the plugin manages, and
+	// managedVars their names, which are written after env files
+	managedEnv  []string
+	managedVars []string
 }
 
 // Run is the programmatic (as opposed to CLI) entrypoint to all
@@ -100,17 +241,28 @@ type Config struct {
 
 // Takes *Config because we need to collect secrets in secretsToRedact
 // as we process different S3 objects, then batch them for redaction at the end
-func Run(conf *Config) error {
+func Run(conf *Config) (err error) {
 	bucket := conf.Client.Bucket()
 	log := conf.Logger
 
+	conf.summary = &summary{}
+	defer func() { annotate(conf, err) }()
+
+	// Objects are audited as stored, before they're verified and decrypted
+	client := conf.Client
+	defer func() { conf.Client = client }()
+	conf.Client = WithAudit(conf.Client, conf.Audit, conf.AuditJob, log)
+	conf.Client = WithDecrypters(WithVerification(conf.Client, conf.TrustedKeys), conf.Decrypters)
+	conf.expiry = newExpiryChecker(conf)
+	conf.Client = &expiringClient{Client: conf.Client, checker: conf.expiry}
+
 	log.Printf("~~~ Downloading secrets from :s3: %s", bucket)
 
 	if ok, err := conf.Client.BucketExists(); !ok {
 		if err != nil {
-			log.Printf("+++ :warning: Bucket %q not found", bucket)
+			warnf(conf, "Bucket %q not found", bucket)
 		} else {
-			log.Printf("+++ :warning: Bucket %q doesn't exist", bucket)
+			warnf(conf, "Bucket %q doesn't exist", bucket)
 		}
 		return fmt.Errorf("S3 bucket %q not found", bucket)
 	}
@@ -118,31 +270,73 @@ func Run(conf *Config) error {
 	resultsSSH := make(chan getResult)
 	getSSHKeys(*conf, resultsSSH)
 
+	resultsSSHConfig := make(chan getResult)
+	getSSHConfig(*conf, resultsSSHConfig)
+
 	resultsEnv := make(chan getResult)
 	getEnvs(*conf, resultsEnv)
 
+	resultsGitHubApp := make(chan getResult)
+	getGitHubApp(*conf, resultsGitHubApp)
+
 	resultsGit := make(chan getResult)
 	getGitCredentials(*conf, resultsGit)
 
 	resultsSecrets := make(chan getResult)
 	getSecrets(*conf, resultsSecrets)
 
+	// known_hosts is written before keys are loaded, as ssh-add looks up the
+	// host keys of destinations in it, and ssh_config after, as it pins keys
+	sshConfig, err := handleSSHConfig(conf, resultsSSHConfig)
+	if err != nil {
+		return err
+	}
 	if err := handleSSHKeys(conf, resultsSSH); err != nil {
 		return err
 	}
+	if err := writeSSHConfig(conf, sshConfig); err != nil {
+		return err
+	}
 	if err := handleEnvs(conf, resultsEnv); err != nil {
 		return err
 	}
+	if err := handleGitHubApp(conf, resultsGitHubApp); err != nil {
+		return err
+	}
 	if err := handleGitCredentials(conf, resultsGit); err != nil {
 		return err
 	}
+	if err := writeGitConfig(conf); err != nil {
+		return err
+	}
 	if err := handleSecrets(conf, resultsSecrets); err != nil {
 		return err
 	}
+	if err := writeEnv(conf); err != nil {
+		return err
+	}
+	if err := writeManagedEnv(conf); err != nil {
+		return err
+	}
+	conf.expiry.report(conf)
+
+	if conf.RequireRedaction && conf.oversizedSecrets > 0 {
+		return fmt.Errorf("refusing to continue with %d secrets larger than %d bytes, which can't be redacted", conf.oversizedSecrets, MaxSecretSize)
+	}
 
 	if len(conf.secretsToRedact) > 0 {
-		if err := redactSecrets(conf.Logger, conf.secretsToRedact); err != nil {
-			conf.Logger.Printf("Warning: Failed to add secrets to redactor: %v", err)
+		redactor := conf.Redactor
+		if redactor == nil {
+			redactor = &agentRedactor{
+				log:      conf.Logger,
+				cacheDir: conf.CacheDir,
+				dir:      func() (string, error) { return jobDirectory(conf) },
+			}
+		}
+		if err := redactor.Redact(conf.secretsToRedact); err != nil {
+			if err := handleUnredactedSecrets(conf, err); err != nil {
+				return err
+			}
 		}
 	} else {
 		conf.Logger.Printf("No secrets collected for redaction")
@@ -151,26 +345,17 @@ func Run(conf *Config) error {
 	return nil
 }
 
-func getSSHKeys(conf Config, results chan<- getResult) {
-	keys := []string{
-		conf.Prefix + "/private_ssh_key",
-		conf.Prefix + "/id_rsa_github",
-		"private_ssh_key",
-		"id_rsa_github",
-	}
-	conf.Logger.Printf("Checking S3 for SSH keys:")
-	for _, k := range keys {
-		conf.Logger.Printf("- %s", k)
-	}
-	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
-}
-
 func getEnvs(conf Config, results chan<- getResult) {
-	keys := []string{
-		"env",
-		"environment",
-		conf.Prefix + "/env",
-		conf.Prefix + "/environment",
+	var keys []string
+	prefixes := []string{"", conf.Prefix + "/"}
+	if conf.StepKey != "" {
+		prefixes = append(prefixes, stepPrefix(&conf)+"/")
+	}
+	for _, prefix := range prefixes {
+		keys = append(keys, prefix+"env", prefix+"environment")
+		for _, ext := range structuredEnvExtensions {
+			keys = append(keys, prefix+"env"+ext)
+		}
 	}
 	conf.Logger.Printf("Checking S3 for environment files:")
 	for _, k := range keys {
@@ -182,9 +367,12 @@ func getEnvs(conf Config, results chan<- getResult) {
 func getSecrets(conf Config, results chan<- getResult) {
 	suffixes := append(conf.SecretSuffixes, defaultSecretSuffixes...)
 
-	prefixes := []string{
-		"secret-files",
-		conf.Prefix + "/secret-files",
+	prefixes := []string{"secret-files"}
+	if pipelineSecretFilesAllowed(&conf) {
+		prefixes = append(prefixes, conf.Prefix+"/secret-files")
+	}
+	if conf.StepKey != "" {
+		prefixes = append(prefixes, stepPrefix(&conf)+"/secret-files")
 	}
 
 	conf.Logger.Printf("Checking S3 for secret-files")
@@ -193,7 +381,7 @@ func getSecrets(conf Config, results chan<- getResult) {
 		conf.Logger.Printf("- %s", p)
 		files, err := conf.Client.ListSuffix(p, suffixes)
 		if err != nil {
-			conf.Logger.Printf("+++ :warning: Failed to list secrets: %v", err)
+			warnf(&conf, "Failed to list secrets: %v", err)
 			continue
 		}
 		keys = append(keys, files...)
@@ -219,8 +407,9 @@ func handleSSHKeys(conf *Config, results <-chan getResult) error {
 	for r := range results {
 		if r.err != nil {
 			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to download ssh-key %s/%s", r.bucket, r.key)
+				warnf(conf, "Failed to download ssh-key %s/%s: %v", r.bucket, r.key, r.err)
 			}
+			conf.summary.skipDownload("SSH key", r)
 			continue
 		}
 		if started, err := conf.SSHAgent.Run(); err != nil {
@@ -228,75 +417,153 @@ func handleSSHKeys(conf *Config, results <-chan getResult) error {
 		} else if started {
 			log.Printf("Started ephemeral ssh-agent (pid %d)", conf.SSHAgent.Pid())
 		}
+		key, publicKey, err := prepareSSHKey(conf, r)
+		if err != nil {
+			return err
+		}
 		log.Printf(
-			"Loading %s/%s (%d bytes) into ssh-agent (pid %d)",
-			r.bucket, r.key, len(r.data), conf.SSHAgent.Pid(),
+			"Loading %s/%s (%s %s) into ssh-agent (pid %d)",
+			r.bucket, r.key, publicKey.Type(), ssh.FingerprintSHA256(publicKey), conf.SSHAgent.Pid(),
 		)
-		if err := conf.SSHAgent.Add(r.data); err != nil {
-			return fmt.Errorf("failed to add ssh-agent")
+		if key.Lifetime > 0 || key.Confirm || len(key.Destinations) > 0 {
+			log.Printf(
+				"Constraining key: lifetime %s, confirm %t, destinations %q",
+				key.Lifetime, key.Confirm, key.Destinations,
+			)
+		}
+		if err := conf.SSHAgent.Add(key); err != nil {
+			return fmt.Errorf("failed to add ssh-key %s/%s to ssh-agent: %w", r.bucket, r.key, err)
 		}
+		conf.summary.load("SSH key", r.key, publicKey.Type()+" "+ssh.FingerprintSHA256(publicKey))
 		keyFound = true
 	}
 	if !keyFound && strings.HasPrefix(conf.Repo, "git@") && !conf.SkipSSHKeyNotFoundWarning {
-		log.Printf("+++ :warning: Failed to find an SSH key in secret bucket")
+		warnf(conf, "Failed to find an SSH key in secret bucket")
 		log.Printf(
 			"The repository %q appears to use SSH for transport, but the elastic-ci-stack-s3-secrets-hooks plugin did not find any SSH keys in the %q S3 bucket.",
 			conf.Repo, conf.Bucket,
 		)
 		log.Printf("See https://buildkite.com/docs/agent/v3/aws/elastic-ci-stack/ec2-linux-and-windows/secrets-bucket for more information.")
 	}
-	if _, err := io.Copy(conf.EnvSink, conf.SSHAgent.Stdout()); err != nil {
+	agentEnv, err := io.ReadAll(conf.SSHAgent.Stdout())
+	if err != nil {
 		return fmt.Errorf("failed in copying ssh-agent env")
 	}
+	if len(agentEnv) > 0 {
+		setManagedEnv(conf, string(agentEnv), "SSH_AUTH_SOCK", "SSH_AGENT_PID")
+	}
 	return nil
 }
 
+const (
+	// envFileKind describes env files in the summary
+	envFileKind = "Env file"
+
+	// secretFileKind describes secret files in the summary
+	secretFileKind = "Secret file"
+)
+
+// handleEnvs parses env files into variables, which are written by writeEnv
+// once every scope is loaded
 func handleEnvs(conf *Config, results <-chan getResult) error {
-	log := conf.Logger
 	for r := range results {
 		if r.err != nil {
 			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to download env from %s/%s", r.bucket, r.key)
+				warnf(conf, "Failed to download env from %s/%s: %v", r.bucket, r.key, r.err)
 			}
+			conf.summary.skipDownload(envFileKind, r)
 			continue
 		}
-		data := r.data
 
-		if len(data) > 0 {
-			if data[len(data)-1] != '\n' {
-				data = append(data, '\n')
-			}
-			log.Printf("Loading %s/%s (%d bytes) of env", r.bucket, r.key, len(r.data))
-
-			// Parse the environment file to extract values for redaction
-			// Use godotenv library to properly handle multi-line secrets and avoid parsing bugs
-			envMap, err := godotenv.UnmarshalBytes(r.data)
-			if err != nil {
-				log.Printf("Warning: failed to parse env file %s/%s", r.bucket, r.key)
-			} else {
-				for key, value := range envMap {
-					if isSecretVar(key) && len(value) > 0 {
-						redactSecret(conf, value)
-					}
-				}
+		var err error
+		switch {
+		case sops.IsEncrypted(r.data):
+			if err = handleSOPSEnv(conf, r); err != nil {
+				err = fmt.Errorf("SOPS decryption failed: %w", err)
 			}
+		case isStructuredEnv(r.key):
+			err = handleStructuredEnv(conf, r)
+		default:
+			err = handleDotenv(conf, r)
+		}
+		if err != nil {
+			warnf(conf, "Failed to load env from %s/%s: %v", r.bucket, r.key, err)
+			conf.summary.skip(envFileKind, r.key, "invalid")
+		}
+	}
+	return nil
+}
 
-			if _, err := bytes.NewReader(data).WriteTo(conf.EnvSink); err != nil {
-				return fmt.Errorf("failed to write environment data")
-			}
+// handleDotenv parses a dotenv file
+func handleDotenv(conf *Config, r getResult) error {
+	vars, warnings, err := parseDotenv(r.data)
+	if err != nil {
+		return err
+	}
+	conf.Logger.Printf("Loading %s/%s (%d bytes) of env", r.bucket, r.key, len(r.data))
+	for _, w := range warnings {
+		warnf(conf, "Ignoring %s of %s/%s", w, r.bucket, r.key)
+	}
+	for _, v := range vars {
+		if v.expires != "" && !checkVarExpiry(conf, r, v.name, v.expires) {
+			continue
+		}
+		conf.envVars = append(conf.envVars, envVar{
+			name:         v.name,
+			value:        v.value,
+			interpolated: v.interpolated,
+			kind:         envFileKind,
+			scope:        envScopeOf(conf, envFileKind, r.key),
+			bucket:       r.bucket,
+			key:          r.key,
+		})
+	}
+	return nil
+}
+
+// handleSOPSEnv decrypts an env file encrypted with SOPS. Its values are
+// literal, as they are in JSON and YAML env files.
+func handleSOPSEnv(conf *Config, r getResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), decryptTimeout)
+	defer cancel()
+	vars, err := sops.Decrypt(ctx, r.data, conf.SOPSKeys)
+	if err != nil {
+		return err
+	}
+	conf.Logger.Printf("Loading %s/%s (%d bytes) of SOPS encrypted env", r.bucket, r.key, len(r.data))
+
+	for _, v := range vars {
+		if !isEnvName(v.Name) {
+			warnf(conf, "Ignoring %s in %s/%s, which isn't a valid environment variable name", v.Name, r.bucket, r.key)
+			continue
+		}
+		// Encrypted values are secrets whatever their names, and the rest are
+		// redacted by the policy, like other env files
+		var secret *bool
+		if v.Encrypted {
+			secret = &v.Encrypted
 		}
+		conf.envVars = append(conf.envVars, envVar{
+			name:   v.Name,
+			value:  v.Value,
+			secret: secret,
+			kind:   envFileKind,
+			scope:  envScopeOf(conf, envFileKind, r.key),
+			bucket: r.bucket,
+			key:    r.key,
+		})
 	}
 	return nil
 }
 
 func handleGitCredentials(conf *Config, results <-chan getResult) error {
 	log := conf.Logger
-	var helpers []string
 	for r := range results {
 		if r.err != nil {
 			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to check %s/%s", r.bucket, r.key)
+				warnf(conf, "Failed to check %s/%s: %v", r.bucket, r.key, r.err)
 			}
+			conf.summary.skipDownload("git-credentials", r)
 			continue
 		}
 		log.Printf("Adding git-credentials in %s/%s as a credential helper", r.bucket, r.key)
@@ -304,30 +571,105 @@ func handleGitCredentials(conf *Config, results <-chan getResult) error {
 		// Replace spaces ' ' in the helper path with an escaped space '\ '
 		escapedCredentialHelper := strings.ReplaceAll(conf.GitCredentialHelper, " ", "\\ ")
 
-		helper := fmt.Sprintf("credential.helper=%s %s %s %s", escapedCredentialHelper, r.bucket, conf.Client.Region(), r.key)
+		helper := fmt.Sprintf("%s %s %s %s", escapedCredentialHelper, r.bucket, conf.Client.Region(), r.key)
+
+		creds, errs := gitcredential.Parse(r.data)
+		for _, err := range errs {
+			warnf(conf, "Ignoring %s/%s %v", r.bucket, r.key, err)
+		}
+		if len(r.data) > 0 && r.data[len(r.data)-1] != '\n' {
+			warnf(conf, "%s/%s doesn't end with a newline, older versions of the credential helper ignore its last line", r.bucket, r.key)
+		}
+
+		// git prints credentials in URLs and error messages, so redact
+		// passwords as written in the file as well as decoded
+		for _, c := range creds {
+			redactSecretVariants(conf, c.Password)
+			if encoded := strings.TrimPrefix(url.UserPassword("", c.Password).String(), ":"); encoded != c.Password {
+				redactSecret(conf, encoded)
+			}
+			redactBasicAuth(conf, c.Username, c.Password)
+		}
 
-		helpers = append(helpers, helper)
+		conf.gitConfig = append(conf.gitConfig, gitCredentialConfig(helper, creds)...)
+		conf.summary.load("git-credentials", r.key, gitCredentialSummary(creds))
 	}
-	if len(helpers) == 0 {
+	return nil
+}
+
+// gitCredentialSummary describes the hosts a git-credentials file has
+// credentials for
+func gitCredentialSummary(creds []gitcredential.Credential) string {
+	if len(creds) == 0 {
+		return "no valid lines, used for all hosts"
+	}
+	var contexts []string
+	for _, c := range creds {
+		if ctx := c.Context(); !slices.Contains(contexts, ctx) {
+			contexts = append(contexts, ctx)
+		}
+	}
+	noun := "credentials"
+	if len(creds) == 1 {
+		noun = "credential"
+	}
+	return fmt.Sprintf("%d %s for %s", len(creds), noun, strings.Join(contexts, ", "))
+}
+
+// gitCredentialConfig returns git configuration registering a credential
+// helper for a git-credentials file. The helper is scoped to the hosts in the
+// file with credential.<url>.helper, and credential.<url>.useHttpPath is set
+// for hosts with credentials for specific paths, so that git sends the path
+// of the repository for the helper to match against. A file without any
+// usable lines is registered for all hosts.
+func gitCredentialConfig(helper string, creds []gitcredential.Credential) []string {
+	if len(creds) == 0 {
+		return []string{"credential.helper=" + helper}
+	}
+
+	var contexts []string
+	usePath := map[string]bool{}
+	for _, c := range creds {
+		ctx := c.Context()
+		if _, ok := usePath[ctx]; !ok {
+			contexts = append(contexts, ctx)
+			usePath[ctx] = false
+		}
+		if c.Path != "" {
+			usePath[ctx] = true
+		}
+	}
+
+	var config []string
+	for _, ctx := range contexts {
+		config = append(config, fmt.Sprintf("credential.%s.helper=%s", ctx, helper))
+		if usePath[ctx] {
+			config = append(config, fmt.Sprintf("credential.%s.useHttpPath=true", ctx))
+		}
+	}
+	return config
+}
+
+// writeGitConfig writes the collected git configuration as
+// GIT_CONFIG_PARAMETERS.
+func writeGitConfig(conf *Config) error {
+	if len(conf.gitConfig) == 0 {
 		return nil
 	}
 
 	// Build an environment variable for interpretation by a shell
-	var singleQuotedHelpers []string
-	for _, helper := range helpers {
+	var singleQuotedEntries []string
+	for _, entry := range conf.gitConfig {
 		// Escape any escape sequences, the shell will interpret the first level
 		// of escaping.
 
 		// Replace backslash '\' with double backslash '\\'
-		helper = strings.ReplaceAll(helper, "\\", "\\\\")
-
-		singleQuotedHelpers = append(singleQuotedHelpers, "'"+helper+"'")
-	}
-	env := "GIT_CONFIG_PARAMETERS=\"" + strings.Join(singleQuotedHelpers, " ") + "\"\n"
+		entry = strings.ReplaceAll(entry, "\\", "\\\\")
 
-	if _, err := io.WriteString(conf.EnvSink, env); err != nil {
-		return fmt.Errorf("failed to write GIT_CONFIG_PARAMETERS env")
+		singleQuotedEntries = append(singleQuotedEntries, "'"+entry+"'")
 	}
+	env := "GIT_CONFIG_PARAMETERS=\"" + strings.Join(singleQuotedEntries, " ") + "\"\n"
+	setManagedEnv(conf, env, "GIT_CONFIG_PARAMETERS")
 	return nil
 }
 
@@ -335,44 +677,34 @@ func handleGitCredentials(conf *Config, results <-chan getResult) error {
 // The key is the last part of the S3 key.
 func handleSecrets(conf *Config, results <-chan getResult) error {
 	log := conf.Logger
-	// Build an environment variable for interpretation by a shell
-	var singleQuotedSecrets []string
-	var envString string
+	secret := true
+	found := 0
 	for r := range results {
 		if r.err != nil {
 			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
-				log.Printf("+++ :warning: Failed to download secret %s/%s", r.bucket, r.key)
+				warnf(conf, "Failed to download secret %s/%s: %v", r.bucket, r.key, r.err)
 			}
+			conf.summary.skipDownload(secretFileKind, r)
 			continue
 		}
 		log.Printf("Adding secret %s/%s to environment", r.bucket, r.key)
-		envKey := strings.Split(r.key, "/")[len(strings.Split(r.key, "/"))-1]
-
-		// Redact both original and shell-escaped versions of the secret to prevent leaks
-		// This fixes an issue where multi-line secrets (like JWT tokens) would appear
-		// unredacted in logs when strconv.Quote transforms them (e.g., newlines > \n).
-		secretData := string(r.data)
-		if len(secretData) > 0 {
-			redactSecret(conf, secretData)
-		}
-
-		quotedValue := strconv.Quote(secretData)
-		if len(quotedValue) >= 2 {
-			unquotedContent := quotedValue[1 : len(quotedValue)-1]
-			if unquotedContent != secretData {
-				redactSecret(conf, unquotedContent)
-			}
-		}
-
-		singleQuotedSecrets = append(singleQuotedSecrets, envKey+"="+quotedValue)
-	}
-	if len(singleQuotedSecrets) == 0 {
+		envKey := path.Base(r.key)
+		conf.summary.load(secretFileKind, r.key, "$"+envKey)
+
+		// Secret files are always redacted, and their values are literal
+		conf.envVars = append(conf.envVars, envVar{
+			name:   envKey,
+			value:  string(r.data),
+			secret: &secret,
+			kind:   secretFileKind,
+			scope:  envScopeOf(conf, secretFileKind, r.key),
+			bucket: r.bucket,
+			key:    r.key,
+		})
+		found++
+	}
+	if found == 0 {
 		log.Printf("No secrets found in %q", conf.Prefix)
-		return nil
-	}
-	envString = strings.Join(singleQuotedSecrets, "\n") + "\n"
-	if _, err := io.WriteString(conf.EnvSink, envString); err != nil {
-		return fmt.Errorf("failed to write secrets to environment")
 	}
 	return nil
 }
@@ -431,6 +763,7 @@ func redactSecret(conf *Config, secretValue string) {
 
 	if len(secretValue) >= MaxSecretSize {
 		conf.Logger.Printf("Warning: Secret is too large for redaction (%d bytes, max %d bytes)", len(secretValue), MaxSecretSize)
+		conf.oversizedSecrets++
 		return
 	}
 
@@ -440,68 +773,22 @@ func redactSecret(conf *Config, secretValue string) {
 	}
 }
 
-// AgentCapabilities holds detected agent version and capabilities
-type AgentCapabilities struct {
-	Version          string
-	SupportsRedactor bool
-}
-
-// detectAgentCapabilities discovers what the buildkite-agent supports.
-// We detect the actual version and check if the redactor command exists.
-// JSON format support is guaranteed when redactor is available.
-func detectAgentCapabilities() AgentCapabilities {
-	caps := AgentCapabilities{
-		Version:          "unknown",
-		SupportsRedactor: false,
-	}
-
-	// Extract version from "buildkite-agent, e.g. version 3.73.0"
-	versionCmd := exec.Command("buildkite-agent", "--version")
-	if versionOutput, err := versionCmd.Output(); err == nil {
-		versionStr := strings.TrimSpace(string(versionOutput))
-		if parts := strings.Fields(versionStr); len(parts) >= 3 {
-			caps.Version = parts[2]
-		}
-	}
-
-	// Test if redactor command exists
-	cmd := exec.Command("buildkite-agent", "redactor", "add", "--help")
-	output, err := cmd.Output()
-	if err != nil {
-		// Command failed completely (e.g., buildkite-agent not found)
-		return caps
-	}
-
-	// Check if the command actually succeeded by looking for redactor-specific content
-	// If "redactor" isn't supported, buildkite-agent shows general help instead
-	helpText := string(output)
-	if !strings.Contains(helpText, "redactor") {
-		// Command ran but redactor subcommand doesn't exist
-		return caps
-	}
-
-	// Redactor command exists
-	caps.SupportsRedactor = true
-
-	return caps
-}
-
-func redactSecrets(log *log.Logger, secrets []string) error {
+// redactSecrets adds secrets to the agent's redactor, in chunks. Agent
+// capabilities are cached in cacheDir. dir returns a private directory for
+// files, used only if the agent can't read secrets from stdin.
+func redactSecrets(log *log.Logger, secrets []string, cacheDir string, dir func() (string, error)) error {
 	if len(secrets) == 0 {
 		return nil
 	}
 
-	if _, err := exec.LookPath("buildkite-agent"); err != nil {
-		log.Printf("Warning: buildkite-agent not found, secrets will not be redacted")
-		return nil
+	caps, err := detectAgentCapabilities(log, cacheDir)
+	if err != nil {
+		return err
 	}
 
-	caps := detectAgentCapabilities()
-
 	if !caps.SupportsRedactor {
-		log.Printf("Warning: agent %s doesn't support secret redaction", caps.Version)
-		log.Printf("Upgrade to buildkite-agent v3.67.0 or later for automatic secret redaction")
-		return nil
+		log.Printf("Upgrade to buildkite-agent v%s or later for automatic secret redaction", agentRedactorVersion)
+		return fmt.Errorf("agent %s: %w", caps.Version, ErrRedactorUnsupported)
 	}
 
 	// Clean up the secrets list by removing empty entries
@@ -522,7 +809,7 @@ func redactSecrets(log *log.Logger, secrets []string) error {
 
 	successfulChunks := 0
 	for i, chunk := range chunks {
-		if err := processSingleChunk(log, chunk, i+1, len(chunks)); err != nil {
+		if err := processSingleChunk(log, chunk, i+1, len(chunks), caps, dir); err != nil {
 			log.Printf("Warning: failed to process chunk %d/%d, some secrets may appear in logs", i+1, len(chunks))
 		} else {
 			successfulChunks++
@@ -532,6 +819,9 @@ func redactSecrets(log *log.Logger, secrets []string) error {
 	if successfulChunks > 0 {
 		log.Printf("Successfully added %d secrets to redactor (%d/%d chunks)", len(validSecrets), successfulChunks, len(chunks))
 	}
+	if successfulChunks < len(chunks) {
+		return fmt.Errorf("failed to add %d of %d chunks to the redactor", len(chunks)-successfulChunks, len(chunks))
+	}
 
 	return nil
 }
@@ -574,9 +864,13 @@ func chunkSecrets(secrets []string, maxJSONSize int) [][]string {
 	return chunks
 }
 
-// processSingleChunk handles one chunk of secrets by creating a temporary JSON file
-// and passing it to buildkite-agent for redaction. The file is created and cleaned up regardless of success or failure.
-func processSingleChunk(log *log.Logger, secrets []string, chunkNum, totalChunks int) error {
+// processSingleChunk handles one chunk of secrets by passing it to
+// buildkite-agent for redaction as JSON. The JSON is streamed over stdin if
+// the agent supports it, so that secrets are never written to disk. Otherwise
+// it's written to a file in the job directory, which is private to the agent
+// user and removed by the pre-exit hook should this process be killed before
+// it removes the file itself.
+func processSingleChunk(log *log.Logger, secrets []string, chunkNum, totalChunks int, caps AgentCapabilities, dir func() (string, error)) error {
 	jsonSecrets := make(map[string]string)
 	for i, secret := range secrets {
 		jsonSecrets[fmt.Sprintf("secret_%d", i)] = secret
@@ -587,40 +881,33 @@ func processSingleChunk(log *log.Logger, secrets []string, chunkNum, totalChunks
 		return fmt.Errorf("failed to marshal chunk %d to JSON: %w", chunkNum, err)
 	}
 
-	tempFile, err := os.CreateTemp("", fmt.Sprintf("buildkite-secrets-chunk-%d-*.json", chunkNum))
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file for chunk %d: %w", chunkNum, err)
-	}
+	cmd := exec.Command("buildkite-agent", "redactor", "add", "--format", "json")
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
 
-	// Ensure the temporary file is always cleaned up, even if something goes wrong.
-	// Set restrictive permissions (0600) so only the current user can read the secrets.
-	defer func() {
-		tempFile.Close()
-		if err := os.Remove(tempFile.Name()); err != nil {
-			log.Printf("Warning: failed to remove temporary secrets file %s", tempFile.Name())
+	if caps.SupportsStdin {
+		cmd.Stdin = bytes.NewReader(jsonData)
+	} else {
+		jobDir, err := dir()
+		if err != nil {
+			return fmt.Errorf("failed to create a directory for chunk %d: %w", chunkNum, err)
 		}
-	}()
+		path := filepath.Join(jobDir, fmt.Sprintf("redactor-chunk-%d.json", chunkNum))
 
-	if err := tempFile.Chmod(0600); err != nil {
-		return fmt.Errorf("failed to set permissions on temporary file for chunk %d", chunkNum)
-	}
-
-	if _, err := tempFile.Write(jsonData); err != nil {
-		return fmt.Errorf("failed to write chunk %d to temporary file", chunkNum)
-	}
-
-	if err := tempFile.Sync(); err != nil {
-		return fmt.Errorf("failed to sync temporary file for chunk %d", chunkNum)
-	}
+		// Ensure the file is always cleaned up, even if something goes wrong
+		defer func() {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Warning: failed to remove temporary secrets file %s", path)
+			}
+		}()
 
-	if err := tempFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file for chunk %d: %w", chunkNum, err)
+		// Restrictive permissions (0600) so only the current user can read the secrets
+		if err := os.WriteFile(path, jsonData, 0o600); err != nil {
+			return fmt.Errorf("failed to write chunk %d to temporary file", chunkNum)
+		}
+		cmd.Args = append(cmd.Args, path)
 	}
 
-	cmd := exec.Command("buildkite-agent", "redactor", "add", "--format", "json", tempFile.Name())
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("buildkite-agent command failed for chunk %d: %w", chunkNum, err)
 	}
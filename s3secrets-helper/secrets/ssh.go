@@ -0,0 +1,462 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/signature"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sshagent"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshKeyOptionsSuffix is appended to the key of an SSH key in S3 to find
+	// its sidecar options file, e.g. private_ssh_key.options
+	sshKeyOptionsSuffix = ".options"
+
+	// sshKeysPrefix is listed in each scope for additional named SSH keys
+	sshKeysPrefix = "ssh-keys/"
+
+	// sshKeyCertificateSuffix is appended to the key of an SSH key in S3 to
+	// find its certificate, e.g. private_ssh_key-cert.pub
+	sshKeyCertificateSuffix = "-cert.pub"
+
+	// sshKeyDefaultUser is the SSH user assumed by match patterns without one
+	sshKeyDefaultUser = "git"
+
+	// sshCertificateExpiryWarning is how long before its expiry a certificate
+	// is warned about, as it would stop working part way through a build.
+	sshCertificateExpiryWarning = 2 * time.Hour
+)
+
+// sshKeyOptions is the JSON document stored in an SSH key's sidecar file:
+//
+//	{"lifetime": "1h", "confirm": false, "destinations": ["github.com"], "match": ["github.com/my-org"]}
+type sshKeyOptions struct {
+	// Lifetime is a Go duration, e.g. "30m" or "2h"
+	Lifetime     string   `json:"lifetime"`
+	Confirm      bool     `json:"confirm"`
+	Destinations []string `json:"destinations"`
+
+	// Match pins the key to hosts or repositories, see parseSSHKeyMatch
+	Match []string `json:"match"`
+}
+
+// sshKeyMatch is a host, optionally narrowed to a repository path, that a key
+// is offered for.
+type sshKeyMatch struct {
+	user string
+	host string
+	path string
+}
+
+// sshIdentity is a key loaded into the agent that is pinned to the hosts or
+// repositories it matches.
+type sshIdentity struct {
+	source      string
+	publicKey   ssh.PublicKey
+	certificate []byte
+	match       []sshKeyMatch
+}
+
+// prepareSSHKey builds the key to load into the agent from a downloaded
+// private key, its options sidecar and its certificate, and records the key
+// if it is pinned to hosts. The public key is returned for logging.
+func prepareSSHKey(conf *Config, r getResult) (sshagent.Key, ssh.PublicKey, error) {
+	publicKey, err := validateSSHKey(r.data)
+	if err != nil {
+		return sshagent.Key{}, nil, fmt.Errorf("ssh-key %s/%s %w", r.bucket, r.key, err)
+	}
+
+	key, match, err := getSSHKeyOptions(conf, r.key, r.data)
+	if err != nil {
+		return key, nil, err
+	}
+
+	cert, err := getSSHCertificate(conf, r.key, publicKey)
+	if err != nil {
+		return key, nil, err
+	}
+	key.Certificate = cert
+
+	if len(match) > 0 {
+		conf.sshIdentities = append(conf.sshIdentities, sshIdentity{
+			source:      r.bucket + "/" + r.key,
+			publicKey:   publicKey,
+			certificate: cert,
+			match:       match,
+		})
+	}
+	return key, publicKey, nil
+}
+
+// validateSSHKey parses private key material before it is given to ssh-add,
+// whose errors don't say what is wrong, and returns its public key. Errors
+// describe common mistakes made when uploading a key, and never include the
+// key material; they read as the end of a sentence about the key.
+func validateSSHKey(data []byte) (ssh.PublicKey, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0:
+		return nil, errors.New("is empty")
+	case bytes.HasPrefix(trimmed, []byte("PuTTY-User-Key-File-")):
+		return nil, errors.New("is a PuTTY key, convert it to OpenSSH format with `puttygen key.ppk -O private-openssh-new -o key`")
+	case bytes.Contains(data, []byte("\r\n")):
+		return nil, errors.New("has Windows (CRLF) line endings, convert them to LF with `dos2unix` before uploading")
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(trimmed); err == nil {
+		return nil, errors.New("is a public key, upload the private key instead")
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		var passphraseErr *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseErr) {
+			return nil, errors.New("is protected by a passphrase, which can't be entered in a build")
+		}
+		// x/crypto/ssh errors describe the format rather than the key contents
+		return nil, fmt.Errorf("is not a PEM or OpenSSH private key: %w", err)
+	}
+	return signer.PublicKey(), nil
+}
+
+// getSSHCertificate downloads the certificate stored next to an SSH key, if
+// any, and checks that it certifies the key and is currently valid.
+func getSSHCertificate(conf *Config, key string, publicKey ssh.PublicKey) ([]byte, error) {
+	certKey := key + sshKeyCertificateSuffix
+	raw, err := conf.Client.Get(certKey)
+	if errors.Is(err, sentinel.ErrNotFound) || errors.Is(err, sentinel.ErrForbidden) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download ssh-key certificate %s/%s: %w", conf.Client.Bucket(), certKey, err)
+	}
+
+	cert, err := checkSSHCertificate(raw, publicKey, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh-key certificate %s/%s: %w", conf.Client.Bucket(), certKey, err)
+	}
+
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		conf.Logger.Printf("Found certificate %s/%s (serial %d), valid forever", conf.Client.Bucket(), certKey, cert.Serial)
+		return raw, nil
+	}
+	expiry := time.Unix(int64(cert.ValidBefore), 0)
+	conf.Logger.Printf("Found certificate %s/%s (serial %d), valid until %s", conf.Client.Bucket(), certKey, cert.Serial, expiry.UTC().Format(time.RFC3339))
+	if remaining := time.Until(expiry); remaining < sshCertificateExpiryWarning {
+		warnf(conf, "Certificate %s/%s expires in %s, SSH connections made after that will fail", conf.Client.Bucket(), certKey, remaining.Round(time.Second))
+	}
+	return raw, nil
+}
+
+// checkSSHCertificate parses a certificate in authorized_keys format and
+// checks that it is a user certificate for the given key that is valid at the
+// given time.
+func checkSSHCertificate(certData []byte, publicKey ssh.PublicKey, now time.Time) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("found a %s public key rather than a certificate", pub.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), publicKey.Marshal()) {
+		return nil, errors.New("the certificate is for a different key")
+	}
+
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return nil, fmt.Errorf("the certificate is not valid until %s", time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return nil, fmt.Errorf("the certificate expired at %s", time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+// getSSHKeyOptions downloads and parses the sidecar options file of an SSH
+// key. A missing sidecar results in an unconstrained, unpinned key.
+func getSSHKeyOptions(conf *Config, key string, data []byte) (sshagent.Key, []sshKeyMatch, error) {
+	k := sshagent.Key{PrivateKey: data}
+
+	optionsKey := key + sshKeyOptionsSuffix
+	raw, err := conf.Client.Get(optionsKey)
+	if errors.Is(err, sentinel.ErrNotFound) || errors.Is(err, sentinel.ErrForbidden) {
+		return k, nil, nil
+	}
+	if err != nil {
+		return k, nil, fmt.Errorf("failed to download ssh-key options %s/%s: %w", conf.Client.Bucket(), optionsKey, err)
+	}
+
+	var opts sshKeyOptions
+	if err := json.Unmarshal(raw, &opts); err != nil {
+		return k, nil, fmt.Errorf("failed to parse ssh-key options %s/%s: %w", conf.Client.Bucket(), optionsKey, err)
+	}
+	if opts.Lifetime != "" {
+		lifetime, err := time.ParseDuration(opts.Lifetime)
+		if err != nil || lifetime <= 0 {
+			return k, nil, fmt.Errorf("invalid lifetime %q in ssh-key options %s/%s", opts.Lifetime, conf.Client.Bucket(), optionsKey)
+		}
+		k.Lifetime = lifetime
+	}
+	k.Confirm = opts.Confirm
+	k.Destinations = opts.Destinations
+	if len(k.Destinations) > 0 && conf.knownHostsFile != "" {
+		k.KnownHosts = knownHostsFiles(conf)
+	}
+
+	var match []sshKeyMatch
+	for _, pattern := range opts.Match {
+		m, err := parseSSHKeyMatch(pattern)
+		if err != nil {
+			return k, nil, fmt.Errorf("invalid match in ssh-key options %s/%s: %w", conf.Client.Bucket(), optionsKey, err)
+		}
+		match = append(match, m)
+	}
+	return k, match, nil
+}
+
+// parseSSHKeyMatch parses a pattern of the form [user@]host[/path], e.g.
+// "github.com" or "github.com/my-org". The user defaults to "git".
+func parseSSHKeyMatch(pattern string) (sshKeyMatch, error) {
+	if pattern == "" || strings.ContainsAny(pattern, " \t\r\n'\"\\*?!") {
+		return sshKeyMatch{}, fmt.Errorf("%q is not a valid host or repository", pattern)
+	}
+	m := sshKeyMatch{user: sshKeyDefaultUser}
+	rest := pattern
+	if i := strings.Index(rest, "@"); i >= 0 && !strings.Contains(rest[:i], "/") {
+		m.user, rest = rest[:i], rest[i+1:]
+	}
+	m.host, m.path, _ = strings.Cut(rest, "/")
+	m.path = strings.Trim(m.path, "/")
+	if m.user == "" || m.host == "" || strings.ContainsAny(m.host, "@:") {
+		return sshKeyMatch{}, fmt.Errorf("%q is not a valid host or repository", pattern)
+	}
+	return m, nil
+}
+
+// insteadOf returns the prefix a repository URL is matched against: an
+// organisation pattern such as "my-org" matches "my-org/", while a repository
+// pattern such as "my-org/repo" is matched as given.
+func (m sshKeyMatch) insteadOf() string {
+	if strings.Contains(m.path, "/") {
+		return m.path
+	}
+	return m.path + "/"
+}
+
+func getSSHKeys(conf Config, results chan<- getResult) {
+	keys := []string{
+		conf.Prefix + "/private_ssh_key",
+		conf.Prefix + "/id_rsa_github",
+		"private_ssh_key",
+		"id_rsa_github",
+	}
+	conf.Logger.Printf("Checking S3 for SSH keys:")
+	for _, k := range keys {
+		conf.Logger.Printf("- %s", k)
+	}
+	for _, p := range []string{conf.Prefix + "/" + sshKeysPrefix, sshKeysPrefix} {
+		conf.Logger.Printf("- %s", p)
+		// Every object under the prefix is a key, apart from sidecar files
+		// and signatures, including those of sidecars and encrypted keys
+		files, err := conf.Client.ListSuffix(p, []string{""})
+		if err != nil {
+			warnf(&conf, "Failed to list SSH keys: %v", err)
+			continue
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f, "/") || strings.HasSuffix(f, sshKeyOptionsSuffix) || strings.HasSuffix(f, sshKeyCertificateSuffix) || strings.HasSuffix(f, signature.Suffix) {
+				continue
+			}
+			keys = append(keys, f)
+		}
+	}
+	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
+}
+
+func getSSHConfig(conf Config, results chan<- getResult) {
+	// The pipeline scope is fetched first, as the first value obtained for a
+	// setting wins in ssh_config(5).
+	keys := []string{
+		conf.Prefix + "/known_hosts",
+		conf.Prefix + "/ssh_config",
+		"known_hosts",
+		"ssh_config",
+	}
+	conf.Logger.Printf("Checking S3 for SSH configuration:")
+	for _, k := range keys {
+		conf.Logger.Printf("- %s", k)
+	}
+	go GetAll(conf.Client, conf.Client.Bucket(), keys, results)
+}
+
+// handleSSHConfig merges known_hosts and ssh_config files from all scopes,
+// writing known_hosts to the job directory so that destination-constrained
+// keys can be loaded against it. It returns the merged ssh_config, which is
+// written by writeSSHConfig once the keys are loaded.
+func handleSSHConfig(conf *Config, results <-chan getResult) ([]byte, error) {
+	log := conf.Logger
+	var knownHosts, downloadedConfig bytes.Buffer
+	for r := range results {
+		if r.err != nil {
+			if r.err != sentinel.ErrNotFound && r.err != sentinel.ErrForbidden {
+				warnf(conf, "Failed to download %s/%s: %v", r.bucket, r.key, r.err)
+			}
+			conf.summary.skipDownload("SSH configuration", r)
+			continue
+		}
+		if len(r.data) == 0 {
+			continue
+		}
+		buf := &downloadedConfig
+		if path.Base(r.key) == "known_hosts" {
+			buf = &knownHosts
+		}
+		log.Printf("Loading %s/%s (%d bytes) of SSH configuration", r.bucket, r.key, len(r.data))
+		conf.summary.load("SSH configuration", r.key, fmt.Sprintf("%d bytes", len(r.data)))
+		fmt.Fprintf(buf, "# s3://%s/%s\n", r.bucket, r.key)
+		buf.Write(r.data)
+		if r.data[len(r.data)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+
+	if knownHosts.Len() > 0 {
+		p, err := writeJobFile(conf, "known_hosts", knownHosts.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		conf.knownHostsFile = p
+	}
+	return downloadedConfig.Bytes(), nil
+}
+
+// writeSSHConfig writes the downloaded ssh_config, after blocks for pinned
+// keys, to the job directory, and points git at it and the downloaded
+// known_hosts via GIT_SSH_COMMAND.
+func writeSSHConfig(conf *Config, downloadedConfig []byte) error {
+	log := conf.Logger
+
+	// Blocks for pinned keys come first, so that their IdentitiesOnly wins over
+	// any setting for the same host in the downloaded configuration.
+	pinned, err := pinnedSSHConfig(conf)
+	if err != nil {
+		return err
+	}
+	sshConfig := bytes.NewBuffer(pinned)
+	sshConfig.Write(downloadedConfig)
+
+	var args []string
+	if sshConfig.Len() > 0 {
+		// -F skips the user and system configuration, so include them again
+		// after the downloaded configuration. "Match all" ends any Host block
+		// left open so that the includes apply unconditionally.
+		sshConfig.WriteString("Match all\n")
+		sshConfig.WriteString("Include ~/.ssh/config\n")
+		sshConfig.WriteString("Include /etc/ssh/ssh_config\n")
+		p, err := writeJobFile(conf, "ssh_config", sshConfig.Bytes())
+		if err != nil {
+			return err
+		}
+		args = append(args, "-F", shellQuote(p))
+	}
+	if conf.knownHostsFile != "" {
+		// The user's own known_hosts is kept so previously trusted hosts still
+		// verify; ssh expands the ~ itself.
+		args = append(args, "-o", shellQuote(`UserKnownHostsFile="`+conf.knownHostsFile+`" ~/.ssh/known_hosts`))
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	command := "ssh " + strings.Join(args, " ")
+	log.Printf("Setting GIT_SSH_COMMAND to use the downloaded SSH configuration")
+	setManagedEnv(conf, "GIT_SSH_COMMAND="+shellQuote(command)+"\n", "GIT_SSH_COMMAND")
+	return nil
+}
+
+// pinnedSSHConfig writes the public keys of pinned identities to the job
+// directory, and returns ssh_config blocks that offer only those keys to the
+// hosts they match. Keys pinned to a repository path are given a host alias,
+// with git rewriting matching repository URLs to use it.
+//
+// IdentityFile refers to the public key; ssh then uses the private key held
+// by the agent, so private key material is never written to disk.
+func pinnedSSHConfig(conf *Config) ([]byte, error) {
+	if len(conf.sshIdentities) == 0 {
+		return nil, nil
+	}
+
+	var hosts []string
+	hostIdentities := map[string][]string{}
+	var aliases bytes.Buffer
+	for i, id := range conf.sshIdentities {
+		name := fmt.Sprintf("ssh-key-%d", i+1)
+		pub, err := writeJobFile(conf, name+".pub", ssh.MarshalAuthorizedKey(id.publicKey))
+		if err != nil {
+			return nil, err
+		}
+		identity := fmt.Sprintf("  IdentityFile \"%s\"\n", pub)
+		if len(id.certificate) > 0 {
+			cert, err := writeJobFile(conf, name+sshKeyCertificateSuffix, id.certificate)
+			if err != nil {
+				return nil, err
+			}
+			identity += fmt.Sprintf("  CertificateFile \"%s\"\n", cert)
+		}
+		for _, m := range id.match {
+			if m.path == "" {
+				if _, ok := hostIdentities[m.host]; !ok {
+					hosts = append(hosts, m.host)
+				}
+				hostIdentities[m.host] = append(hostIdentities[m.host], identity)
+				continue
+			}
+
+			alias := fmt.Sprintf("%s-s3-secrets-key-%d", m.host, i+1)
+			fmt.Fprintf(&aliases, "# %s\n", id.source)
+			fmt.Fprintf(&aliases, "Host %s\n  HostName %s\n%s  IdentitiesOnly yes\n", alias, m.host, identity)
+			conf.gitConfig = append(conf.gitConfig,
+				fmt.Sprintf("url.%s@%s:%s.insteadOf=%s@%s:%s", m.user, alias, m.insteadOf(), m.user, m.host, m.insteadOf()),
+				fmt.Sprintf("url.ssh://%s@%s/%s.insteadOf=ssh://%s@%s/%s", m.user, alias, m.insteadOf(), m.user, m.host, m.insteadOf()),
+			)
+		}
+		conf.Logger.Printf("Pinning %s to %d host(s) or repositories", id.source, len(id.match))
+	}
+
+	var out bytes.Buffer
+	out.Write(aliases.Bytes())
+	for _, host := range hosts {
+		fmt.Fprintf(&out, "Host %s\n", host)
+		for _, identity := range hostIdentities[host] {
+			out.WriteString(identity)
+		}
+		out.WriteString("  IdentitiesOnly yes\n")
+	}
+	return out.Bytes(), nil
+}
+
+// knownHostsFiles returns the known_hosts files ssh-add looks up the host keys
+// of a key's destinations in: the downloaded known_hosts, then the files ssh
+// uses with GIT_SSH_COMMAND, as giving ssh-add any file replaces its defaults.
+func knownHostsFiles(conf *Config) []string {
+	files := []string{conf.knownHostsFile}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	return append(files, "/etc/ssh/ssh_known_hosts")
+}
@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// stepAllowlistKey is the key, within the pipeline's prefix, of the list of
+// steps that load the pipeline's secret files in step-only mode
+const stepAllowlistKey = "step-allowlist"
+
+// stepAllowlistKind describes the step allowlist in the summary
+const stepAllowlistKind = "Step allowlist"
+
+// stepPrefix is the prefix of the step's env files and secret files
+func stepPrefix(conf *Config) string {
+	return conf.Prefix + "/steps/" + conf.StepKey
+}
+
+// parseStepAllowlist parses a step allowlist, which has a step key per
+// line. Blank lines and lines starting with # are ignored.
+func parseStepAllowlist(data []byte) []string {
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+// pipelineSecretFilesAllowed reports whether the pipeline's secret files are
+// loaded, which in step-only mode needs the step to be in the allowlist
+func pipelineSecretFilesAllowed(conf *Config) bool {
+	if !conf.StepOnly {
+		return true
+	}
+	skipping := fmt.Sprintf("Step-only mode: skipping %s/secret-files", conf.Prefix)
+	skip := func(reason string) bool {
+		conf.Logger.Printf("%s, as %s", skipping, reason)
+		conf.summary.skipStepOnly(reason)
+		return false
+	}
+	if conf.StepKey == "" {
+		return skip("the step has no key")
+	}
+
+	r := getResult{bucket: conf.Client.Bucket(), key: conf.Prefix + "/" + stepAllowlistKey}
+	r.data, r.err = conf.Client.Get(r.key)
+	if r.err != nil {
+		if !errors.Is(r.err, sentinel.ErrNotFound) && !errors.Is(r.err, sentinel.ErrForbidden) {
+			warnf(conf, "Failed to download step allowlist %s/%s: %v", r.bucket, r.key, r.err)
+		}
+		conf.summary.skipDownload(stepAllowlistKind, r)
+		return skip(fmt.Sprintf("there's no step allowlist at %s/%s", r.bucket, r.key))
+	}
+	if !slices.Contains(parseStepAllowlist(r.data), conf.StepKey) {
+		conf.summary.load(stepAllowlistKind, r.key, fmt.Sprintf("step %s not listed", conf.StepKey))
+		return skip(fmt.Sprintf("step %q isn't listed in %s/%s", conf.StepKey, r.bucket, r.key))
+	}
+	conf.summary.load(stepAllowlistKind, r.key, fmt.Sprintf("step %s listed", conf.StepKey))
+	conf.Logger.Printf("Step %q is listed in %s/%s", conf.StepKey, r.bucket, r.key)
+	return true
+}
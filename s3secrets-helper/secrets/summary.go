@@ -0,0 +1,192 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+)
+
+// Annotator adds an annotation to the build
+type Annotator interface {
+	Annotate(body, style, context string) error
+}
+
+// summary collects what was loaded and skipped, and any warnings, for an
+// annotation. It never holds secret values, only object keys, names and
+// fingerprints.
+type summary struct {
+	loaded   []summaryItem
+	skipped  []summaryItem
+	warnings []string
+
+	// stepOnlySkip is why step-only mode skipped the pipeline's secret files,
+	// if it did
+	stepOnlySkip string
+}
+
+type summaryItem struct {
+	kind, key, detail string
+}
+
+// load records that an object was loaded. A nil summary ignores it, so that
+// handlers can be called without Run.
+func (s *summary) load(kind, key, detail string) {
+	if s != nil {
+		s.loaded = append(s.loaded, summaryItem{kind, key, detail})
+	}
+}
+
+// skip records that an object was found but not used, and why
+func (s *summary) skip(kind, key, reason string) {
+	if s != nil {
+		s.skipped = append(s.skipped, summaryItem{kind, key, reason})
+	}
+}
+
+// skipDownload records a failed download. Objects that don't exist aren't
+// recorded, as most of the keys checked normally don't.
+func (s *summary) skipDownload(kind string, r getResult) {
+	if s == nil {
+		return
+	}
+	switch {
+	case errors.Is(r.err, sentinel.ErrNotFound):
+	case errors.Is(r.err, sentinel.ErrForbidden):
+		s.skip(kind, r.key, "access denied")
+	case errors.Is(r.err, sentinel.ErrUnverified):
+		s.skip(kind, r.key, "signature not verified")
+	case errors.Is(r.err, sentinel.ErrExpired):
+		s.skip(kind, r.key, "expired")
+	default:
+		s.skip(kind, r.key, "download failed")
+	}
+}
+
+// skipStepOnly records why step-only mode skipped the pipeline's secret files
+func (s *summary) skipStepOnly(reason string) {
+	if s != nil {
+		s.stepOnlySkip = reason
+	}
+}
+
+// warnf logs a warning, and records it for the summary
+func warnf(conf *Config, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	conf.Logger.Printf("+++ :warning: %s", msg)
+	if conf.summary != nil {
+		conf.summary.warnings = append(conf.summary.warnings, msg)
+	}
+}
+
+// markdown renders the summary of a run, which failed if runErr is non-nil,
+// returning it with the annotation style to use.
+func (s *summary) markdown(conf *Config, runErr error) (string, string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#### :s3: Secrets from %s\n\n", code(conf.Bucket))
+	checked := code(conf.Prefix + "/")
+	if conf.StepKey != "" {
+		checked = code(stepPrefix(conf)+"/") + ", " + checked
+	}
+	fmt.Fprintf(&b, "Checked %s and %s.\n\n", checked, "the root of the bucket")
+	if s.stepOnlySkip != "" {
+		fmt.Fprintf(&b, "Step-only mode skipped %s, as %s.\n\n", code(conf.Prefix+"/secret-files"), escapeMarkdown(s.stepOnlySkip))
+	}
+
+	style := "info"
+	if runErr != nil {
+		style = "error"
+		fmt.Fprintf(&b, "**Failed:** %s\n\n", escapeMarkdown(runErr.Error()))
+	} else if len(s.warnings) > 0 || len(s.skipped) > 0 {
+		style = "warning"
+	}
+
+	table := func(title, column string, items []summaryItem) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "**%s**\n\n| Type | Object | %s |\n| --- | --- | --- |\n", title, column)
+		for _, item := range items {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", item.kind, code(item.key), escapeMarkdown(item.detail))
+		}
+		b.WriteString("\n")
+	}
+	if len(s.loaded) == 0 {
+		b.WriteString("No secrets were loaded.\n\n")
+	}
+	table("Loaded", "Details", s.loaded)
+	table("Skipped", "Reason", s.skipped)
+
+	if len(s.warnings) > 0 {
+		b.WriteString("**Warnings**\n\n")
+		for _, w := range s.warnings {
+			fmt.Fprintf(&b, "- %s\n", escapeMarkdown(w))
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n") + "\n", style
+}
+
+// annotate adds the summary to the build, if enabled. Failing to annotate
+// only logs a warning, as the annotation is informational.
+func annotate(conf *Config, runErr error) {
+	if !conf.Annotate || conf.summary == nil {
+		return
+	}
+	annotator := conf.Annotator
+	if annotator == nil {
+		annotator = &agentAnnotator{log: conf.Logger, cacheDir: conf.CacheDir}
+	}
+
+	context := "s3-secrets"
+	if conf.JobID != "" {
+		context += "-" + conf.JobID
+	}
+	body, style := conf.summary.markdown(conf, runErr)
+	if err := annotator.Annotate(body, style, context); err != nil {
+		conf.Logger.Printf("Warning: failed to annotate the build: %v", err)
+	}
+}
+
+// code formats s as inline code in markdown
+func code(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "'") + "`"
+}
+
+// escapeMarkdown escapes characters that would otherwise be interpreted as
+// markdown or HTML in a table cell or list item
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\", "|", "\\|", "*", "\\*", "_", "\\_", "`", "\\`",
+		"<", "&lt;", ">", "&gt;", "\n", " ",
+	).Replace(s)
+}
+
+// agentAnnotator annotates the build with buildkite-agent annotate
+type agentAnnotator struct {
+	log *log.Logger
+
+	// cacheDir caches the agent's capabilities between jobs
+	cacheDir string
+}
+
+func (a *agentAnnotator) Annotate(body, style, context string) error {
+	caps, err := detectAgentCapabilities(a.log, a.cacheDir)
+	if err != nil {
+		return err
+	}
+	if !caps.SupportsAnnotate {
+		return fmt.Errorf("agent %s doesn't support annotate", caps.Version)
+	}
+	cmd := exec.Command("buildkite-agent", "annotate", "--style", style, "--context", context)
+	cmd.Stdin = strings.NewReader(body)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("buildkite-agent annotate: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
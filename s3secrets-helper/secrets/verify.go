@@ -0,0 +1,50 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/object"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sentinel"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/signature"
+)
+
+// WithVerification returns a client that refuses objects without a
+// companion .sig signed by one of keys, of the object's contents bound to its
+// key by signature.Message, returning an error wrapping
+// sentinel.ErrUnverified. Objects that don't exist are still reported as
+// sentinel.ErrNotFound.
+func WithVerification(c Client, keys []signature.PublicKey) Client {
+	if len(keys) == 0 {
+		return c
+	}
+	return &verifyingClient{Client: c, keys: keys}
+}
+
+type verifyingClient struct {
+	Client
+	keys []signature.PublicKey
+}
+
+func (c *verifyingClient) Get(key string) ([]byte, error) {
+	data, _, err := c.GetWithInfo(key)
+	return data, err
+}
+
+func (c *verifyingClient) GetWithInfo(key string) ([]byte, object.Info, error) {
+	data, info, err := getWithInfo(c.Client, key)
+	if err != nil {
+		return nil, info, err
+	}
+	sig, err := c.Client.Get(key + signature.Suffix)
+	if errors.Is(err, sentinel.ErrNotFound) {
+		return nil, info, fmt.Errorf("%w: no signature at %s%s", sentinel.ErrUnverified, key, signature.Suffix)
+	}
+	if err != nil {
+		return nil, info, fmt.Errorf("%w: failed to download %s%s: %v", sentinel.ErrUnverified, key, signature.Suffix, err)
+	}
+	if err := signature.Verify(c.keys, signature.Message(key, data), sig); err != nil {
+		return nil, info, fmt.Errorf("%w: %s%s: %v", sentinel.ErrUnverified, key, signature.Suffix, err)
+	}
+	return data, info, nil
+}
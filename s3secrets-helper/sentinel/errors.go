@@ -10,4 +10,11 @@ var (
 
 	// ErrForbidden indicates something was forbidden
 	ErrForbidden = errors.New("Forbidden")
+
+	// ErrUnverified indicates something was refused because its signature
+	// was missing or invalid
+	ErrUnverified = errors.New("Unverified")
+
+	// ErrExpired indicates something was refused because it has expired
+	ErrExpired = errors.New("Expired")
 )
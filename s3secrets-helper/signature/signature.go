@@ -0,0 +1,153 @@
+// Package signature verifies detached ed25519 and minisign signatures of
+// secret objects, so that objects planted by someone who can write to the
+// bucket but doesn't hold a signing key are refused.
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Suffix is appended to an object's key for the key of its signature
+const Suffix = ".sig"
+
+// keyHeader starts the line naming the object's key that is signed before
+// its contents, so that a signed object copied to another key is refused
+const keyHeader = "s3-secrets-key: "
+
+// Message returns what is signed for the object stored at key with data:
+// a line naming the key, then the object's contents
+func Message(key string, data []byte) []byte {
+	return append([]byte(keyHeader+key+"\n"), data...)
+}
+
+const (
+	// minisignComment starts the comment lines of minisign keys and
+	// signatures
+	minisignComment = "untrusted comment:"
+
+	// minisignTrustedComment starts the signed comment line of a minisign
+	// signature
+	minisignTrustedComment = "trusted comment: "
+)
+
+// PublicKey is a trusted ed25519 public key
+type PublicKey struct {
+	// ID is the minisign key ID, or nil for a raw ed25519 key. Minisign
+	// signatures are only checked against keys with the same ID, or no ID.
+	ID []byte
+
+	Key ed25519.PublicKey
+}
+
+// ParsePublicKeys parses public keys, one per line, either as minisign
+// public keys or base64 encoded raw ed25519 keys. Blank lines, minisign
+// comments and lines starting with # are ignored.
+func ParsePublicKeys(data []byte) ([]PublicKey, error) {
+	var keys []PublicKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, minisignComment) {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid public key: %v", i+1, err)
+		}
+		switch {
+		case len(b) == ed25519.PublicKeySize:
+			keys = append(keys, PublicKey{Key: b})
+		case len(b) == 2+8+ed25519.PublicKeySize && string(b[:2]) == "Ed":
+			keys = append(keys, PublicKey{ID: b[2:10], Key: b[10:]})
+		default:
+			return nil, fmt.Errorf("line %d: not an ed25519 or minisign public key", i+1)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys")
+	}
+	return keys, nil
+}
+
+// Verify checks that sig is a signature of message by one of keys. sig may
+// be a minisign signature, or a raw ed25519 signature, optionally base64
+// encoded.
+func Verify(keys []PublicKey, message, sig []byte) error {
+	if bytes.HasPrefix(sig, []byte(minisignComment)) {
+		return verifyMinisign(keys, message, sig)
+	}
+
+	raw := sig
+	if b, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err == nil && len(b) == ed25519.SignatureSize {
+		raw = b
+	}
+	if len(raw) != ed25519.SignatureSize {
+		return errors.New("not an ed25519 or minisign signature")
+	}
+	for _, k := range keys {
+		if ed25519.Verify(k.Key, message, raw) {
+			return nil
+		}
+	}
+	return errors.New("not signed by a trusted key")
+}
+
+// verifyMinisign checks a minisign signature, which has four lines: an
+// untrusted comment, the signature of the message, a trusted comment, and
+// a global signature of the signature and the trusted comment
+func verifyMinisign(keys []PublicKey, message, sig []byte) error {
+	lines := strings.Split(strings.TrimRight(string(sig), "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return errors.New("invalid minisign signature")
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(b) != 2+8+ed25519.SignatureSize {
+		return errors.New("invalid minisign signature")
+	}
+	algorithm, keyID, signature := string(b[:2]), b[2:10], b[10:]
+	globalSignature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSignature) != ed25519.SignatureSize {
+		return errors.New("invalid minisign global signature")
+	}
+	trustedComment := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), minisignTrustedComment)
+
+	signed := message
+	switch algorithm {
+	case "Ed":
+	case "ED":
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", algorithm)
+	}
+
+	for _, k := range keys {
+		if k.ID != nil && !bytes.Equal(k.ID, keyID) {
+			continue
+		}
+		if !ed25519.Verify(k.Key, signed, signature) {
+			continue
+		}
+		if !ed25519.Verify(k.Key, append(bytes.Clone(signature), trustedComment...), globalSignature) {
+			return errors.New("invalid minisign trusted comment signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("not signed by a trusted key (minisign key ID %X)", reverse(keyID))
+}
+
+// reverse returns a reversed copy of b, as minisign displays key IDs as
+// little endian numbers
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
@@ -0,0 +1,110 @@
+package signature_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/signature"
+	"golang.org/x/crypto/blake2b"
+)
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// minisignPublicKey formats public the way minisign -G does
+func minisignPublicKey(keyID []byte, public ed25519.PublicKey) string {
+	b := append(append([]byte("Ed"), keyID...), public...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(b) + "\n"
+}
+
+// minisign signs message the way minisign -S does, prehashed unless legacy
+func minisign(private ed25519.PrivateKey, keyID, message []byte, legacy bool) []byte {
+	algorithm, signed := "ED", message
+	if legacy {
+		algorithm = "Ed"
+	} else {
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	}
+	sig := ed25519.Sign(private, signed)
+	trustedComment := "timestamp:1760749323\tfile:env"
+	global := ed25519.Sign(private, append(append([]byte{}, sig...), trustedComment...))
+	b := append(append([]byte(algorithm), keyID...), sig...)
+	return fmt.Appendf(nil, "untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(b), trustedComment, base64.StdEncoding.EncodeToString(global))
+}
+
+func TestVerify(t *testing.T) {
+	public, private := generateKey(t)
+	minisignPublic, minisignPrivate := generateKey(t)
+	_, untrusted := generateKey(t)
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	keys, err := signature.ParsePublicKeys([]byte(
+		"# release signing key\n" +
+			base64.StdEncoding.EncodeToString(public) + "\n\n" +
+			minisignPublicKey(keyID, minisignPublic),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+
+	message := []byte("A=one\n")
+	raw := ed25519.Sign(private, message)
+	for name, sig := range map[string][]byte{
+		"raw":              raw,
+		"base64":           []byte(base64.StdEncoding.EncodeToString(raw) + "\n"),
+		"minisign":         minisign(minisignPrivate, keyID, message, false),
+		"minisign legacy":  minisign(minisignPrivate, keyID, message, true),
+		"minisign raw key": minisign(private, []byte("otherkey"), message, false),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := signature.Verify(keys, message, sig); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	tamperedGlobal := minisign(minisignPrivate, keyID, message, false)
+	tamperedGlobal[len("untrusted comment: signature from minisign secret key\n")+100] ^= 1
+	for name, sig := range map[string][]byte{
+		"wrong message":      ed25519.Sign(private, []byte("A=two\n")),
+		"untrusted key":      ed25519.Sign(untrusted, message),
+		"minisign wrong key": minisign(untrusted, keyID, message, false),
+		"minisign wrong ID":  minisign(minisignPrivate, []byte("otherkey"), message, false),
+		"minisign tampered":  tamperedGlobal,
+		"empty":              nil,
+		"not a signature":    []byte("hello"),
+		"minisign truncated": minisign(minisignPrivate, keyID, message, false)[:80],
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := signature.Verify(keys, message, sig); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestParsePublicKeysInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"# no keys\n",
+		"not base64!\n",
+		base64.StdEncoding.EncodeToString([]byte("too short")) + "\n",
+	} {
+		if _, err := signature.ParsePublicKeys([]byte(data)); err == nil {
+			t.Errorf("expected an error parsing %q", data)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+// Package sops decrypts documents encrypted with SOPS
+// (https://github.com/getsops/sops) in dotenv, YAML or JSON format, so the
+// same encrypted env file can be kept in git and uploaded to the bucket.
+//
+// Data keys encrypted with AWS KMS or age are supported. Other key types,
+// and key groups, are not.
+package sops
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// metadataKey holds the SOPS metadata in YAML and JSON documents, and
+// prefixes the flattened metadata in dotenv documents
+const metadataKey = "sops"
+
+// KMS decrypts data keys encrypted with the KMS key arn
+type KMS interface {
+	DecryptKey(ctx context.Context, arn string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+// Keys are used to decrypt a document's data key
+type Keys struct {
+	// KMS decrypts data keys encrypted with KMS keys, if set
+	KMS KMS
+
+	// AgeIdentities decrypt data keys encrypted to age recipients
+	AgeIdentities []age.Identity
+}
+
+// Var is a top level value in a document
+type Var struct {
+	Name  string
+	Value string
+
+	// Encrypted is set for values the document's rules encrypted, as opposed
+	// to those left in plaintext by unencrypted_suffix and the like
+	Encrypted bool
+}
+
+type kmsKey struct {
+	ARN          string            `yaml:"arn"`
+	Context      map[string]string `yaml:"context"`
+	EncryptedKey string            `yaml:"enc"`
+}
+
+type ageKey struct {
+	Recipient    string `yaml:"recipient"`
+	EncryptedKey string `yaml:"enc"`
+}
+
+type metadata struct {
+	KMS               []kmsKey `yaml:"kms"`
+	Age               []ageKey `yaml:"age"`
+	KeyGroups         []any    `yaml:"key_groups"`
+	LastModified      string   `yaml:"lastmodified"`
+	MAC               string   `yaml:"mac"`
+	UnencryptedSuffix string   `yaml:"unencrypted_suffix"`
+	EncryptedSuffix   string   `yaml:"encrypted_suffix"`
+	UnencryptedRegex  string   `yaml:"unencrypted_regex"`
+	EncryptedRegex    string   `yaml:"encrypted_regex"`
+	MACOnlyEncrypted  bool     `yaml:"mac_only_encrypted"`
+}
+
+// leaf is a value in a document, with the keys leading to it
+type leaf struct {
+	path  []string
+	value string
+
+	// top is set for values directly under the root of the document
+	top bool
+}
+
+// document is a parsed document, with its values still encrypted
+type document struct {
+	leaves   []leaf
+	metadata metadata
+}
+
+// IsEncrypted reports whether data is a document encrypted with SOPS
+func IsEncrypted(data []byte) bool {
+	if isDotenv(data) {
+		return true
+	}
+	var doc struct {
+		SOPS *struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	return doc.SOPS != nil && doc.SOPS.MAC != ""
+}
+
+// Decrypt decrypts a document encrypted with SOPS, verifies its MAC, and
+// returns its values. The document must be flat, with only strings, numbers
+// and booleans at the top level.
+func Decrypt(ctx context.Context, data []byte, keys Keys) ([]Var, error) {
+	var doc *document
+	var err error
+	if isDotenv(data) {
+		doc, err = parseDotenv(data)
+	} else {
+		doc, err = parseYAML(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	md := doc.metadata
+	if len(md.KeyGroups) > 0 {
+		return nil, errors.New("SOPS key groups are not supported")
+	}
+	rules, err := newEncryptionRules(md)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := decryptDataKey(ctx, md, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []Var
+	hash := sha512.New()
+	for _, l := range doc.leaves {
+		value := l.value
+		encrypted := rules.encrypted(l.path)
+		if encrypted {
+			additionalData := strings.Join(l.path, ":") + ":"
+			if value, err = decryptValue(l.value, dataKey, additionalData); err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %w", strings.Join(l.path, "."), err)
+			}
+		}
+		if encrypted || !md.MACOnlyEncrypted {
+			hash.Write([]byte(value))
+		}
+		if !l.top {
+			return nil, fmt.Errorf("%s is nested, only top level values can be loaded", strings.Join(l.path, "."))
+		}
+		vars = append(vars, Var{Name: l.path[0], Value: value, Encrypted: encrypted})
+	}
+
+	if err := verifyMAC(md, dataKey, fmt.Sprintf("%X", hash.Sum(nil))); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func verifyMAC(md metadata, dataKey []byte, computed string) error {
+	lastModified, err := time.Parse(time.RFC3339, md.LastModified)
+	if err != nil {
+		return fmt.Errorf("invalid SOPS lastmodified %q", md.LastModified)
+	}
+	mac, err := decryptValue(md.MAC, dataKey, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt SOPS MAC: %w", err)
+	}
+	if mac != computed {
+		return errors.New("SOPS MAC mismatch, the document has been modified")
+	}
+	return nil
+}
+
+// decryptDataKey decrypts the document's data key with the first of its KMS
+// keys or age recipients that can
+func decryptDataKey(ctx context.Context, md metadata, keys Keys) ([]byte, error) {
+	var errs []error
+	if keys.KMS != nil {
+		for _, k := range md.KMS {
+			encryptedKey, err := base64.StdEncoding.DecodeString(k.EncryptedKey)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("KMS key %s: %w", k.ARN, err))
+				continue
+			}
+			dataKey, err := keys.KMS.DecryptKey(ctx, k.ARN, encryptedKey, k.Context)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("KMS key %s: %w", k.ARN, err))
+				continue
+			}
+			return dataKey, nil
+		}
+	}
+	if len(keys.AgeIdentities) > 0 {
+		for _, k := range md.Age {
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(k.EncryptedKey)), keys.AgeIdentities...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("age recipient %s: %w", k.Recipient, err))
+				continue
+			}
+			dataKey, err := io.ReadAll(r)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("age recipient %s: %w", k.Recipient, err))
+				continue
+			}
+			return dataKey, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no KMS key or age identity available for the SOPS data key (%d KMS keys, %d age recipients)", len(md.KMS), len(md.Age))
+	}
+	return nil, fmt.Errorf("failed to decrypt the SOPS data key: %w", errors.Join(errs...))
+}
+
+var encryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// decryptValue decrypts a value in the form
+// ENC[AES256_GCM,data:...,iv:...,tag:...,type:...]
+func decryptValue(value string, dataKey []byte, additionalData string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	m := encryptedValue.FindStringSubmatch(value)
+	if m == nil {
+		return "", errors.New("value is not encrypted")
+	}
+	var parts [3][]byte
+	for i, s := range m[1:4] {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid encrypted value: %w", err)
+		}
+		parts[i] = b
+	}
+	ciphertext, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(additionalData))
+	if err != nil {
+		return "", errors.New("message authentication failed")
+	}
+	return string(plaintext), nil
+}
+
+// encryptionRules decide which values SOPS encrypted, from the suffix or
+// regex in the metadata
+type encryptionRules struct {
+	unencryptedSuffix string
+	encryptedSuffix   string
+	unencryptedRegex  *regexp.Regexp
+	encryptedRegex    *regexp.Regexp
+}
+
+func newEncryptionRules(md metadata) (*encryptionRules, error) {
+	rules := &encryptionRules{
+		unencryptedSuffix: md.UnencryptedSuffix,
+		encryptedSuffix:   md.EncryptedSuffix,
+	}
+	var err error
+	if md.UnencryptedRegex != "" {
+		if rules.unencryptedRegex, err = regexp.Compile(md.UnencryptedRegex); err != nil {
+			return nil, fmt.Errorf("invalid SOPS unencrypted_regex: %w", err)
+		}
+	}
+	if md.EncryptedRegex != "" {
+		if rules.encryptedRegex, err = regexp.Compile(md.EncryptedRegex); err != nil {
+			return nil, fmt.Errorf("invalid SOPS encrypted_regex: %w", err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *encryptionRules) encrypted(path []string) bool {
+	anyKey := func(match func(string) bool) bool {
+		for _, k := range path {
+			if match(k) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case r.unencryptedSuffix != "":
+		return !anyKey(func(k string) bool { return strings.HasSuffix(k, r.unencryptedSuffix) })
+	case r.encryptedSuffix != "":
+		return anyKey(func(k string) bool { return strings.HasSuffix(k, r.encryptedSuffix) })
+	case r.unencryptedRegex != nil:
+		return !anyKey(r.unencryptedRegex.MatchString)
+	case r.encryptedRegex != nil:
+		return anyKey(r.encryptedRegex.MatchString)
+	}
+	return true
+}
+
+// isDotenv reports whether data is a dotenv document with SOPS metadata
+func isDotenv(data []byte) bool {
+	for line := range bytes.SplitSeq(data, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte(metadataKey+"_mac=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// dotenvMetadataKey matches the flattened keys of the KMS and age entries in
+// dotenv metadata, such as sops_kms__list_0__map_arn
+var dotenvMetadataKey = regexp.MustCompile(`^(kms|age)__list_(\d+)__map_(.+)$`)
+
+func parseDotenv(data []byte) (*document, error) {
+	doc := &document{}
+	flat := map[string]string{}
+	for line := range bytes.SplitSeq(data, []byte("\n")) {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, value, ok := strings.Cut(string(line), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid dotenv line %q", key)
+		}
+		value = strings.ReplaceAll(value, `\n`, "\n")
+		if k, ok := strings.CutPrefix(key, metadataKey+"_"); ok {
+			flat[k] = value
+			continue
+		}
+		doc.leaves = append(doc.leaves, leaf{path: []string{key}, value: value, top: true})
+	}
+
+	md := &doc.metadata
+	for k, v := range flat {
+		switch k {
+		case "lastmodified":
+			md.LastModified = v
+		case "mac":
+			md.MAC = v
+		case "unencrypted_suffix":
+			md.UnencryptedSuffix = v
+		case "encrypted_suffix":
+			md.EncryptedSuffix = v
+		case "unencrypted_regex":
+			md.UnencryptedRegex = v
+		case "encrypted_regex":
+			md.EncryptedRegex = v
+		case "mac_only_encrypted":
+			md.MACOnlyEncrypted = v == "true"
+		}
+		if strings.HasPrefix(k, "key_groups") {
+			md.KeyGroups = append(md.KeyGroups, k)
+		}
+
+		m := dotenvMetadataKey.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		i, err := strconv.Atoi(m[2])
+		if err != nil || i > len(flat) {
+			return nil, fmt.Errorf("invalid SOPS metadata key %q", k)
+		}
+		switch m[1] {
+		case "kms":
+			for len(md.KMS) <= i {
+				md.KMS = append(md.KMS, kmsKey{})
+			}
+			switch field := m[3]; {
+			case field == "arn":
+				md.KMS[i].ARN = v
+			case field == "enc":
+				md.KMS[i].EncryptedKey = v
+			case strings.HasPrefix(field, "context__map_"):
+				if md.KMS[i].Context == nil {
+					md.KMS[i].Context = map[string]string{}
+				}
+				md.KMS[i].Context[strings.TrimPrefix(field, "context__map_")] = v
+			}
+		case "age":
+			for len(md.Age) <= i {
+				md.Age = append(md.Age, ageKey{})
+			}
+			switch m[3] {
+			case "recipient":
+				md.Age[i].Recipient = v
+			case "enc":
+				md.Age[i].EncryptedKey = v
+			}
+		}
+	}
+	return doc, nil
+}
+
+// parseYAML parses a YAML or JSON document, which YAML is a superset of,
+// keeping the order of keys that the MAC depends on
+func parseYAML(data []byte) (*document, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) != 1 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("SOPS document is not a map")
+	}
+	doc := &document{}
+
+	top := root.Content[0]
+	var found bool
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, value := top.Content[i], top.Content[i+1]
+		if key.Value == metadataKey {
+			if err := value.Decode(&doc.metadata); err != nil {
+				return nil, fmt.Errorf("invalid SOPS metadata: %w", err)
+			}
+			found = true
+			continue
+		}
+		if err := doc.walk(value, []string{key.Value}, true); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, errors.New("no SOPS metadata")
+	}
+	return doc, nil
+}
+
+// walk collects the scalar values under n in document order. Like SOPS,
+// keys are added to the path but list indexes are not.
+func (d *document) walk(n *yaml.Node, path []string, top bool) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		d.leaves = append(d.leaves, leaf{path: path, value: n.Value, top: top})
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if err := d.walk(n.Content[i+1], append(path[:len(path):len(path)], n.Content[i].Value), false); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := d.walk(c, path, false); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported YAML at %s", strings.Join(path, "."))
+	}
+	return nil
+}
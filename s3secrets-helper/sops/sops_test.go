@@ -0,0 +1,274 @@
+package sops_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/buildkite/elastic-ci-stack-s3-secrets-hooks/s3secrets-helper/v2/sops"
+)
+
+const lastModified = "2026-10-18T01:02:03Z"
+
+const kmsARN = "arn:aws:kms:us-east-1:123456789012:key/abcd"
+
+// fakeKMS "encrypts" a data key by prefixing it with the ARN
+type fakeKMS struct {
+	context map[string]string
+}
+
+func (k *fakeKMS) DecryptKey(ctx context.Context, arn string, encryptedKey []byte, encryptionContext map[string]string) ([]byte, error) {
+	dataKey, ok := bytes.CutPrefix(encryptedKey, []byte(arn))
+	if !ok || !maps.Equal(k.context, encryptionContext) {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return dataKey, nil
+}
+
+// encryptor writes values the way SOPS does, for tests
+type encryptor struct {
+	t       *testing.T
+	dataKey []byte
+	values  []string
+}
+
+func newEncryptor(t *testing.T) *encryptor {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	return &encryptor{t: t, dataKey: dataKey}
+}
+
+func (e *encryptor) seal(value, additionalData string) string {
+	block, err := aes.NewCipher(e.dataKey)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, 32)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	iv := make([]byte, 32)
+	if _, err := rand.Read(iv); err != nil {
+		e.t.Fatal(err)
+	}
+	sealed := gcm.Seal(nil, iv, []byte(value), []byte(additionalData))
+	data, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]", b64(data), b64(iv), b64(tag))
+}
+
+// encrypt encrypts value at path, adding it to the MAC
+func (e *encryptor) encrypt(value string, path ...string) string {
+	e.values = append(e.values, value)
+	return e.seal(value, strings.Join(path, ":")+":")
+}
+
+// plain adds an unencrypted value to the MAC
+func (e *encryptor) plain(value string) string {
+	e.values = append(e.values, value)
+	return value
+}
+
+func (e *encryptor) mac() string {
+	hash := sha512.New()
+	for _, v := range e.values {
+		hash.Write([]byte(v))
+	}
+	return e.seal(fmt.Sprintf("%X", hash.Sum(nil)), lastModified)
+}
+
+func (e *encryptor) kmsKey() string {
+	return base64.StdEncoding.EncodeToString(append([]byte(kmsARN), e.dataKey...))
+}
+
+func (e *encryptor) ageKey(recipient age.Recipient) string {
+	buf := &bytes.Buffer{}
+	a := armor.NewWriter(buf)
+	w, err := age.Encrypt(a, recipient)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if _, err := w.Write(e.dataKey); err != nil {
+		e.t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		e.t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		e.t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestDecryptDotenv(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newEncryptor(t)
+	doc := strings.Join([]string{
+		"#ENC[AES256_GCM,data:aaaa,iv:bbbb,tag:cccc,type:comment]",
+		"API_TOKEN=" + e.encrypt("abc123", "API_TOKEN"),
+		"MULTI_LINE=" + e.encrypt("one\ntwo", "MULTI_LINE"),
+		"REGION_unencrypted=" + e.plain("us-east-1"),
+		"sops_age__list_0__map_recipient=" + identity.Recipient().String(),
+		"sops_age__list_0__map_enc=" + strings.ReplaceAll(e.ageKey(identity.Recipient()), "\n", `\n`),
+		"sops_lastmodified=" + lastModified,
+		"sops_mac=" + e.mac(),
+		"sops_unencrypted_suffix=_unencrypted",
+		"sops_version=3.9.0",
+	}, "\n") + "\n"
+
+	if !sops.IsEncrypted([]byte(doc)) {
+		t.Fatal("expected the document to be detected")
+	}
+	vars, err := sops.Decrypt(context.Background(), []byte(doc), sops.Keys{AgeIdentities: []age.Identity{identity}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sops.Var{
+		{Name: "API_TOKEN", Value: "abc123", Encrypted: true},
+		{Name: "MULTI_LINE", Value: "one\ntwo", Encrypted: true},
+		{Name: "REGION_unencrypted", Value: "us-east-1"},
+	}
+	if !reflect.DeepEqual(expected, vars) {
+		t.Errorf("expected %v, got %v", expected, vars)
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sops.Decrypt(context.Background(), []byte(doc), sops.Keys{AgeIdentities: []age.Identity{other}}); err == nil {
+		t.Error("expected an error decrypting with the wrong identity")
+	}
+	if _, err := sops.Decrypt(context.Background(), []byte(doc), sops.Keys{}); err == nil {
+		t.Error("expected an error decrypting without keys")
+	}
+}
+
+func TestDecryptYAMLAndJSON(t *testing.T) {
+	kmsContext := map[string]string{"Team": "platform"}
+	keys := sops.Keys{KMS: &fakeKMS{context: kmsContext}}
+
+	e := newEncryptor(t)
+	yamlDoc := strings.Join([]string{
+		"DATABASE_PASSWORD: " + e.encrypt("hunter2", "DATABASE_PASSWORD"),
+		"PORT: " + e.encrypt("5432", "PORT"),
+		"EMPTY: ''",
+		"sops:",
+		"  kms:",
+		"    - arn: " + kmsARN,
+		"      context:",
+		"        Team: platform",
+		"      enc: " + e.kmsKey(),
+		"  lastmodified: \"" + lastModified + "\"",
+		"  mac: " + e.mac(),
+		"  version: 3.9.0",
+	}, "\n") + "\n"
+
+	e = newEncryptor(t)
+	jsonDoc := fmt.Sprintf(`{
+	"DATABASE_PASSWORD": %q,
+	"PORT": %q,
+	"EMPTY": "",
+	"sops": {
+		"kms": [{"arn": %q, "context": {"Team": "platform"}, "enc": %q}],
+		"lastmodified": %q,
+		"mac": %q,
+		"version": "3.9.0"
+	}
+}`, e.encrypt("hunter2", "DATABASE_PASSWORD"), e.encrypt("5432", "PORT"), kmsARN, e.kmsKey(), lastModified, e.mac())
+
+	expected := []sops.Var{
+		{Name: "DATABASE_PASSWORD", Value: "hunter2", Encrypted: true},
+		{Name: "PORT", Value: "5432", Encrypted: true},
+		{Name: "EMPTY", Value: "", Encrypted: true},
+	}
+	for name, doc := range map[string]string{"yaml": yamlDoc, "json": jsonDoc} {
+		t.Run(name, func(t *testing.T) {
+			if !sops.IsEncrypted([]byte(doc)) {
+				t.Fatal("expected the document to be detected")
+			}
+			vars, err := sops.Decrypt(context.Background(), []byte(doc), keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, vars) {
+				t.Errorf("expected %v, got %v", expected, vars)
+			}
+			if _, err := sops.Decrypt(context.Background(), []byte(doc), sops.Keys{KMS: &fakeKMS{}}); err == nil {
+				t.Error("expected an error decrypting with the wrong encryption context")
+			}
+		})
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := sops.Keys{AgeIdentities: []age.Identity{identity}}
+
+	e := newEncryptor(t)
+	a, b := e.encrypt("one", "A"), e.encrypt("two", "B")
+	metadata := []string{
+		"sops:",
+		"  age:",
+		"    - recipient: " + identity.Recipient().String(),
+		"      enc: |",
+		"        " + strings.ReplaceAll(strings.TrimSpace(e.ageKey(identity.Recipient())), "\n", "\n        "),
+		"  lastmodified: \"" + lastModified + "\"",
+		"  mac: " + e.mac(),
+	}
+	document := func(lines ...string) []byte {
+		return []byte(strings.Join(append(lines, metadata...), "\n") + "\n")
+	}
+
+	if _, err := sops.Decrypt(context.Background(), document("A: "+a, "B: "+b), keys); err != nil {
+		t.Fatalf("expected the untampered document to decrypt: %v", err)
+	}
+	for name, doc := range map[string][]byte{
+		"swapped values":  document("A: "+b, "B: "+a),
+		"removed value":   document("A: " + a),
+		"reordered":       document("B: "+b, "A: "+a),
+		"plaintext value": document("A: "+a, "B: two"),
+		"added value":     document("A: "+a, "B: "+b, "C: "+e.encrypt("three", "C")),
+		"nested":          document("A: "+a, "B: "+b, "C:", "  D: "+e.encrypt("four", "C", "D")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if vars, err := sops.Decrypt(context.Background(), doc, keys); err == nil {
+				t.Errorf("expected an error, got %v", vars)
+			}
+		})
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	for _, doc := range []string{
+		"A=one\nB=two\n",
+		"A: one\n",
+		`{"A": "one"}`,
+		"sops: true\n",
+		"",
+	} {
+		if sops.IsEncrypted([]byte(doc)) {
+			t.Errorf("expected %q not to be detected as encrypted", doc)
+		}
+	}
+}
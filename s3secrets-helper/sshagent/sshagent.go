@@ -5,10 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
@@ -21,6 +27,32 @@ var (
 	regexpPid  = regexp.MustCompile("(?m)^SSH_AGENT_PID=(.*); export SSH_AGENT_PID;$")
 )
 
+// Key is a private key and the constraints it is loaded into the agent with.
+type Key struct {
+	// PrivateKey is the key material, in any format understood by ssh-add
+	PrivateKey []byte
+
+	// Certificate is an optional OpenSSH certificate for the key, in
+	// authorized_keys format, loaded into the agent alongside it
+	Certificate []byte
+
+	// Lifetime is the maximum time the agent holds the key for (ssh-add -t).
+	// Zero means the key is held for the lifetime of the agent.
+	Lifetime time.Duration
+
+	// Confirm requires each use of the key to be confirmed (ssh-add -c).
+	// The ssh-agent must have an SSH_ASKPASS program able to confirm.
+	Confirm bool
+
+	// Destinations restricts the key to the given hosts (ssh-add -h),
+	// e.g. "github.com" or "git@github.com". Requires OpenSSH 8.9 or later.
+	Destinations []string
+
+	// KnownHosts are the known_hosts files the host keys of Destinations are
+	// looked up in (ssh-add -H). If empty, ssh-add uses the default files.
+	KnownHosts []string
+}
+
 // Agent represents an ssh-agent
 type Agent struct {
 	pid  int
@@ -73,20 +105,117 @@ func (a *Agent) Run() (bool, error) {
 	return true, nil
 }
 
-// Add wraps `ssh-agent add`
-func (a *Agent) Add(key []byte) error {
+// Add wraps `ssh-agent add`, applying any constraints of the key.
+func (a *Agent) Add(key Key) error {
 	if a.pid == 0 || a.sock == "" {
 		return errors.New("Agent must Run() before Add()")
 	}
-	cmd := exec.Command("ssh-add", "-")
-	key = append(key, '\n')
-	cmd.Stdin = bytes.NewReader(key)
+	args, err := addArgs(key)
+	if err != nil {
+		return err
+	}
+	if len(key.Certificate) > 0 {
+		return a.addWithCertificate(key)
+	}
+	cmd := a.command(append(args, "-")...)
+	data := append(bytes.Clone(key.PrivateKey), '\n')
+	cmd.Stdin = bytes.NewReader(data)
+	return run(cmd)
+}
+
+// addWithCertificate loads a key together with its certificate. ssh-add only
+// reads certificates from a file next to the key's file, so rather than
+// writing the key to disk, it's sent to the agent over its socket. The agent
+// protocol client can't express destination constraints, which ssh-add
+// builds from known_hosts, so they aren't supported with certificates.
+func (a *Agent) addWithCertificate(key Key) error {
+	if len(key.Destinations) > 0 {
+		return errors.New("destination constraints can't be applied to a key with a certificate")
+	}
+	privateKey, err := ssh.ParseRawPrivateKey(key.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("parsing key: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(key.Certificate)
+	if err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return errors.New("parsing certificate: not an SSH certificate")
+	}
+
+	conn, err := net.Dial("unix", a.sock)
+	if err != nil {
+		return fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+	err = agent.NewClient(conn).Add(agent.AddedKey{
+		PrivateKey:       privateKey,
+		Certificate:      cert,
+		LifetimeSecs:     lifetimeSecs(key.Lifetime),
+		ConfirmBeforeUse: key.Confirm,
+	})
+	if err != nil {
+		return fmt.Errorf("adding key to ssh-agent: %w", err)
+	}
+	return nil
+}
+
+// command returns an ssh-add command that talks to the agent.
+func (a *Agent) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("ssh-add", args...)
 	cmd.Env = []string{
 		"SSH_AGENT_PID=" + strconv.Itoa(a.pid),
 		"SSH_AUTH_SOCK=" + a.sock,
 		"SSH_ASKPASS=/bin/false",
 	}
-	return cmd.Run()
+	return cmd
+}
+
+// addArgs returns the ssh-add flags for the constraints of a key.
+func addArgs(key Key) ([]string, error) {
+	var args []string
+	if key.Lifetime < 0 {
+		return nil, fmt.Errorf("invalid key lifetime %s", key.Lifetime)
+	}
+	if key.Lifetime > 0 {
+		args = append(args, "-t", strconv.FormatUint(uint64(lifetimeSecs(key.Lifetime)), 10))
+	}
+	if key.Confirm {
+		args = append(args, "-c")
+	}
+	for _, d := range key.Destinations {
+		if d == "" || strings.HasPrefix(d, "-") || strings.ContainsAny(d, " \t\r\n") {
+			return nil, fmt.Errorf("invalid key destination %q", d)
+		}
+		args = append(args, "-h", d)
+	}
+	if len(key.Destinations) > 0 {
+		for _, f := range key.KnownHosts {
+			args = append(args, "-H", f)
+		}
+	}
+	return args, nil
+}
+
+// lifetimeSecs converts a key lifetime to the whole seconds the agent takes,
+// rounding up so that short lifetimes aren't zero
+func lifetimeSecs(lifetime time.Duration) uint32 {
+	return uint32((lifetime + time.Second - 1) / time.Second)
+}
+
+// run runs an ssh-add command, including its output in any error so that the
+// reason for the failure is reported.
+func run(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("ssh-add: %w: %s", err, msg)
+		}
+		return fmt.Errorf("ssh-add: %w", err)
+	}
+	return nil
 }
 
 // Pid is the process ID of the ssh-agent, either found in existing
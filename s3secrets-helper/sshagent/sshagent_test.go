@@ -1,6 +1,19 @@
 package sshagent
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
 
 func TestParseOutputSock(t *testing.T) {
 	out := `SSH_AUTH_SOCK=/path/to/socket; export SSH_AUTH_SOCK;
@@ -29,3 +42,114 @@ echo Agent pid 42
 		t.Errorf("pid expected %d, got %d", expected, actual)
 	}
 }
+
+func TestAddArgs(t *testing.T) {
+	args, err := addArgs(Key{
+		Lifetime:     90 * time.Minute,
+		Confirm:      true,
+		Destinations: []string{"github.com", "git@gitlab.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-t", "5400", "-c", "-h", "github.com", "-h", "git@gitlab.example.com"}
+	if !slices.Equal(expected, args) {
+		t.Errorf("args expected %q, got %q", expected, args)
+	}
+
+	args, err = addArgs(Key{Destinations: []string{"github.com"}, KnownHosts: []string{"/job/known_hosts"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"-h", "github.com", "-H", "/job/known_hosts"}
+	if !slices.Equal(expected, args) {
+		t.Errorf("args expected %q, got %q", expected, args)
+	}
+
+	if args, err := addArgs(Key{KnownHosts: []string{"/job/known_hosts"}}); err != nil || len(args) != 0 {
+		t.Errorf("expected no known_hosts without destinations, got %q (%v)", args, err)
+	}
+
+	if args, err := addArgs(Key{}); err != nil || len(args) != 0 {
+		t.Errorf("expected no args for an unconstrained key, got %q (%v)", args, err)
+	}
+
+	if _, err := addArgs(Key{Destinations: []string{"-oProxyCommand=x"}}); err == nil {
+		t.Error("expected an error for a destination that looks like a flag")
+	}
+}
+
+func TestAddWithCertificate(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent not found")
+	}
+	t.Setenv(envSock, "")
+	t.Setenv(envPID, "")
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"git"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Agent{}
+	if _, err := a.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if p, err := os.FindProcess(a.Pid()); err == nil {
+			p.Kill()
+		}
+	})
+	key := Key{PrivateKey: pem.EncodeToMemory(block), Certificate: ssh.MarshalAuthorizedKey(cert), Lifetime: time.Hour}
+	if err := a.Add(key); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", a.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Format != ssh.CertAlgoED25519v01 {
+		t.Errorf("expected the certificate to be loaded, got %v", keys)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) > 0 {
+		t.Errorf("expected nothing to be written to TMPDIR, got %v", entries)
+	}
+
+	key.Destinations = []string{"github.com"}
+	if err := a.Add(key); err == nil {
+		t.Error("expected an error for destinations with a certificate")
+	}
+}